@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/superhuman/goose/lib/goose"
+	"log"
+)
+
+var baselineCmd = &Command{
+	Name:    "baseline",
+	Usage:   "VERSION|FILENAME",
+	Summary: "Mark the DB as migrated up to the given version, without running any migrations",
+	Help:    `baseline extended help here...`,
+	Run:     baselineRun,
+}
+
+func baselineRun(cmd *Command, args ...string) {
+
+	if len(args) < 1 {
+		log.Fatal("goose baseline: version required")
+	}
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	version, err := goose.ResolveVersion(conf, args[0])
+	if err != nil {
+		log.Fatal("goose baseline: invalid version: ", err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal("couldn't open DB:", err)
+	}
+	defer db.Close()
+
+	if err := goose.BaselineOnDb(conf, db, version); err != nil {
+		log.Fatal(err)
+	}
+}
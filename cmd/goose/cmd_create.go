@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"text/template"
 	"time"
 )
 
@@ -17,6 +18,19 @@ var createCmd = &Command{
 	Run:     createRun,
 }
 
+var createVersioning string
+var createTemplate string
+var createGoRun bool
+
+func init() {
+	createCmd.Flag.StringVar(&createVersioning, "versioning", "",
+		"number the migration by 'timestamp' or 'sequential' version (default = same as existing migrations)")
+	createCmd.Flag.StringVar(&createTemplate, "template", "",
+		"text/template file to generate the migration from, given its .Version, .Name and .Package (default = goose's own)")
+	createCmd.Flag.BoolVar(&createGoRun, "go-run", false,
+		"create a Go migration to be run via go run, rather than one registered via goose.AddMigration")
+}
+
 func createRun(cmd *Command, args ...string) {
 
 	if len(args) < 1 {
@@ -27,6 +41,9 @@ func createRun(cmd *Command, args ...string) {
 	if len(args) >= 2 {
 		migrationType = args[1]
 	}
+	if migrationType == "go" && createGoRun {
+		migrationType = "go-run"
+	}
 
 	conf, err := dbConfFromFlags()
 	if err != nil {
@@ -37,7 +54,14 @@ func createRun(cmd *Command, args ...string) {
 		log.Fatal(err)
 	}
 
-	n, err := goose.CreateMigration(args[0], migrationType, conf.MigrationsDir, time.Now())
+	var tmpl *template.Template
+	if createTemplate != "" {
+		if tmpl, err = template.ParseFiles(createTemplate); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	n, err := goose.CreateMigrationFromTemplate(args[0], migrationType, conf.MigrationsDir, time.Now(), createVersioning, tmpl)
 	if err != nil {
 		log.Fatal(err)
 	}
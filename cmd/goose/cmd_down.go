@@ -20,17 +20,13 @@ func downRun(cmd *Command, args ...string) {
 		log.Fatal(err)
 	}
 
-	current, err := goose.GetDBVersion(conf)
+	db, err := goose.OpenDBFromDBConf(conf)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	previous, err := goose.GetPreviousDBVersion(conf.MigrationsDir, current)
-	if err != nil {
-		log.Fatal(err)
+		log.Fatal("couldn't open DB:", err)
 	}
+	defer db.Close()
 
-	if err = goose.RunMigrations(conf, conf.MigrationsDir, previous); err != nil {
+	if err := goose.DownByOneOnDb(conf, db); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/superhuman/goose/lib/goose"
+	"log"
+)
+
+var downToCmd = &Command{
+	Name:    "down-to",
+	Usage:   "VERSION|FILENAME",
+	Summary: "Roll back the DB to the given version",
+	Help:    `down-to extended help here...`,
+	Run:     downToRun,
+}
+
+func downToRun(cmd *Command, args ...string) {
+
+	if len(args) < 1 {
+		log.Fatal("goose down-to: version required")
+	}
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	version, err := goose.ResolveVersion(conf, args[0])
+	if err != nil {
+		log.Fatal("goose down-to: invalid version: ", err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal("couldn't open DB:", err)
+	}
+	defer db.Close()
+
+	if err := goose.DownToOnDb(conf, db, version); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/superhuman/goose/lib/goose"
+	"log"
+)
+
+var fixCmd = &Command{
+	Name:    "fix",
+	Usage:   "",
+	Summary: "Renumber timestamp versioned migrations sequentially, unless any have been applied",
+	Help:    `fix extended help here...`,
+	Run:     fixRun,
+}
+
+func fixRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal("couldn't open DB:", err)
+	}
+	defer db.Close()
+
+	if err := goose.FixOnDb(conf, db); err != nil {
+		log.Fatal(err)
+	}
+}
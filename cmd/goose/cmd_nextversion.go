@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/superhuman/goose/lib/goose"
+	"fmt"
+	"log"
+	"time"
+)
+
+var nextVersionCmd = &Command{
+	Name:    "next-version",
+	Usage:   "",
+	Summary: "Print the version that create would give a new migration",
+	Help:    `next-version extended help here...`,
+	Run:     nextVersionRun,
+}
+
+var nextVersionVersioning string
+
+func init() {
+	nextVersionCmd.Flag.StringVar(&nextVersionVersioning, "versioning", "",
+		"number the migration by 'timestamp' or 'sequential' version (default = same as existing migrations)")
+}
+
+func nextVersionRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	v, err := goose.NextVersionAt(conf.MigrationsDir, time.Now(), nextVersionVersioning)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(goose.FormatVersion(v))
+}
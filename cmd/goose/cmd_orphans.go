@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"github.com/superhuman/goose/lib/goose"
+	"log"
+)
+
+var orphansCmd = &Command{
+	Name:    "orphans",
+	Usage:   "",
+	Summary: "List applied versions with no migration file, and fail if there are any",
+	Help:    `orphans extended help here...`,
+	Run:     orphansRun,
+}
+
+func orphansRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal("couldn't open DB:", err)
+	}
+	defer db.Close()
+
+	orphans, err := goose.CheckOrphansOnDb(conf, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(orphans) == 0 {
+		fmt.Printf("goose: every applied version has a migration in %v\n", conf.MigrationsDir)
+		return
+	}
+
+	log.Fatalf("goose: applied version(s) %v have no migration in %v", orphans, conf.MigrationsDir)
+}
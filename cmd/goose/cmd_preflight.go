@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"github.com/superhuman/goose/lib/goose"
+	"log"
+)
+
+var preflightCmd = &Command{
+	Name:    "preflight",
+	Usage:   "",
+	Summary: "Check that the DB can be connected to, and that goose may record migrations in it",
+	Help:    `preflight extended help here...`,
+	Run:     preflightRun,
+}
+
+func preflightRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := goose.CheckPermissions(conf); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("goose: connected to db environment '%v', and can record migrations in %v\n", conf.Env, conf.VersionTableName())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/superhuman/goose/lib/goose"
+	"log"
+)
+
+var resetCmd = &Command{
+	Name:    "reset",
+	Usage:   "",
+	Summary: "Roll back every applied migration",
+	Help:    `reset extended help here...`,
+	Run:     resetRun,
+}
+
+var resetDropTable bool
+
+func init() {
+	resetCmd.Flag.BoolVar(&resetDropTable, "drop-table", false, "drop the version table once every migration is rolled back")
+}
+
+func resetRun(cmd *Command, args ...string) {
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := goose.OpenDBFromDBConf(conf)
+	if err != nil {
+		log.Fatal("couldn't open DB:", err)
+	}
+	defer db.Close()
+
+	if err := goose.ResetOnDb(conf, db, resetDropTable); err != nil {
+		log.Fatal(err)
+	}
+}
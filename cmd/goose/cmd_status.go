@@ -1,11 +1,11 @@
 package main
 
 import (
-	"github.com/superhuman/goose/lib/goose"
-	"database/sql"
+	"encoding/json"
 	"fmt"
+	"github.com/superhuman/goose/lib/goose"
 	"log"
-	"path/filepath"
+	"os"
 	"time"
 )
 
@@ -17,11 +17,33 @@ var statusCmd = &Command{
 	Run:     statusRun,
 }
 
+var statusJSON bool
+
+func init() {
+	statusCmd.Flag.BoolVar(&statusJSON, "json", false, "print the status as JSON")
+}
+
 type StatusData struct {
 	Source string
 	Status string
 }
 
+// machine-readable status, for -json
+type jsonStatus struct {
+	CurrentVersion int64                 `json:"currentVersion"`
+	Pending        int                   `json:"pending"`
+	Migrations     []jsonMigrationStatus `json:"migrations"`
+}
+
+type jsonMigrationStatus struct {
+	Version      int64      `json:"version"`
+	Source       string     `json:"source"` // empty if the version has no file on disk
+	Applied      bool       `json:"applied"`
+	AppliedAt    *time.Time `json:"appliedAt"`
+	DurationMs   *int64     `json:"durationMs"` // null if not recorded
+	Irreversible bool       `json:"irreversible"`
+}
+
 func statusRun(cmd *Command, args ...string) {
 
 	conf, err := dbConfFromFlags()
@@ -29,49 +51,81 @@ func statusRun(cmd *Command, args ...string) {
 		log.Fatal(err)
 	}
 
-	// collect all migrations
-	min := int64(0)
-	max := int64((1 << 63) - 1)
-	migrations, e := goose.CollectMigrations(conf.MigrationsDir, min, max)
-	if e != nil {
-		log.Fatal(e)
-	}
-
 	db, e := goose.OpenDBFromDBConf(conf)
 	if e != nil {
 		log.Fatal("couldn't open DB:", e)
 	}
 	defer db.Close()
 
-	// must ensure that the version table exists if we're running on a pristine DB
-	if _, e := goose.EnsureDBVersion(conf, db); e != nil {
+	status, e := goose.StatusOnDb(conf, db)
+	if e != nil {
 		log.Fatal(e)
 	}
 
+	if statusJSON {
+		current, e := goose.EnsureDBVersion(conf, db)
+		if e != nil {
+			log.Fatal(e)
+		}
+		printJSONStatus(current, status)
+		return
+	}
+
 	fmt.Printf("goose: status for environment '%v'\n", conf.Env)
 	fmt.Println("    Applied At                  Migration")
 	fmt.Println("    =======================================")
-	for _, m := range migrations {
-		printMigrationStatus(db, m.Version, filepath.Base(m.Source))
+	for _, ms := range status {
+		printMigrationStatus(ms)
 	}
 }
 
-func printMigrationStatus(db *sql.DB, version int64, script string) {
-	var row goose.MigrationRecord
-	q := fmt.Sprintf("SELECT tstamp, is_applied FROM goose_db_version WHERE version_id=%d ORDER BY tstamp DESC LIMIT 1", version)
-	e := db.QueryRow(q).Scan(&row.TStamp, &row.IsApplied)
-
-	if e != nil && e != sql.ErrNoRows {
-		log.Fatal(e)
-	}
-
+func printMigrationStatus(ms goose.MigrationStatus) {
 	var appliedAt string
 
-	if row.IsApplied {
-		appliedAt = row.TStamp.Format(time.ANSIC)
+	if ms.Applied {
+		appliedAt = ms.AppliedAt.Format(time.ANSIC)
 	} else {
 		appliedAt = "Pending"
 	}
 
+	script := ms.Name
+	if script == "" {
+		script = fmt.Sprintf("(no file for version %d)", ms.Version)
+	}
+	if ms.Irreversible {
+		script += " (irreversible)"
+	}
+	if ms.Duration > 0 {
+		script += fmt.Sprintf(" (took %v)", ms.Duration)
+	}
+
 	fmt.Printf("    %-24s -- %v\n", appliedAt, script)
 }
+
+// print the status of each migration on disk, plus any applied
+// versions that no longer have a file on disk
+func printJSONStatus(current int64, status []goose.MigrationStatus) {
+
+	js := jsonStatus{CurrentVersion: current, Migrations: []jsonMigrationStatus{}}
+
+	for _, ms := range status {
+		jms := jsonMigrationStatus{Version: ms.Version, Source: ms.Name, Applied: ms.Applied, Irreversible: ms.Irreversible}
+		if ms.Applied {
+			appliedAt := ms.AppliedAt
+			jms.AppliedAt = &appliedAt
+			if ms.Duration > 0 {
+				durationMs := ms.Duration.Milliseconds()
+				jms.DurationMs = &durationMs
+			}
+		} else {
+			js.Pending++
+		}
+		js.Migrations = append(js.Migrations, jms)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(js); err != nil {
+		log.Fatal(err)
+	}
+}
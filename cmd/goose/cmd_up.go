@@ -20,12 +20,13 @@ func upRun(cmd *Command, args ...string) {
 		log.Fatal(err)
 	}
 
-	target, err := goose.GetMostRecentDBVersion(conf.MigrationsDir)
+	db, err := goose.OpenDBFromDBConf(conf)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("couldn't open DB:", err)
 	}
+	defer db.Close()
 
-	if err := goose.RunMigrations(conf, conf.MigrationsDir, target); err != nil {
+	if err := goose.UpOnDb(conf, db); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/superhuman/goose/lib/goose"
+	"log"
+)
+
+var upToCmd = &Command{
+	Name:    "up-to",
+	Usage:   "VERSION|FILENAME",
+	Summary: "Migrate the DB up to the given version, or that of the given migration",
+	Help:    `up-to extended help here...`,
+	Run:     upToRun,
+}
+
+func upToRun(cmd *Command, args ...string) {
+
+	if len(args) < 1 {
+		log.Fatal("goose up-to: version required")
+	}
+
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	version, err := goose.ResolveVersion(conf, args[0])
+	if err != nil {
+		log.Fatal("goose up-to: invalid version: ", err)
+	}
+
+	if err := goose.RunMigrations(conf, conf.MigrationsDir, version, "up"); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"github.com/superhuman/goose/lib/goose"
+	"log"
+)
+
+var validateCmd = &Command{
+	Name:    "validate",
+	Usage:   "",
+	Summary: "Check every migration without running any",
+	Help:    `validate extended help here...`,
+	Run:     validateRun,
+}
+
+var validateScratchURL string
+
+func init() {
+	validateCmd.Flag.StringVar(&validateScratchURL, "scratch", "",
+		"URL of a scratch database to check that each SQL migration's Down undoes its Up on, e.g. postgres://localhost/scratch")
+}
+
+func validateRun(cmd *Command, args ...string) {
+	conf, err := dbConfFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = goose.ValidateConf(conf); err != nil {
+		log.Fatal(err)
+	}
+
+	if validateScratchURL != "" {
+		scratch, err := goose.NewDBConfFromURL(validateScratchURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// the migrations are still those of conf
+		sconf := *conf
+		sconf.Driver = scratch.Driver
+		sconf.OpenStrFunc = nil
+		sconf.Env = "scratch"
+
+		db, err := goose.OpenDBFromDBConf(&sconf)
+		if err != nil {
+			log.Fatal("couldn't open DB:", err)
+		}
+		defer db.Close()
+
+		broken, err := goose.CheckDownMigrationsOnDb(&sconf, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(broken) > 0 {
+			log.Fatalf("goose: the Down migrations of version(s) %v don't restore the schema", broken)
+		}
+	}
+
+	fmt.Printf("goose: migrations in %v are valid\n", conf.MigrationsDir)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"github.com/superhuman/goose/lib/goose"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 )
@@ -13,19 +15,87 @@ import (
 var flagPath = flag.String("path", "db", "folder containing db info")
 var flagEnv = flag.String("env", "development", "which DB environment to use")
 var flagPgSchema = flag.String("pgschema", "", "which postgres-schema to migrate (default = none)")
+var flagURL = flag.String("url", "", "database URL to use instead of dbconf.yml, e.g. $DATABASE_URL")
+var flagAllowDuplicates = flag.Bool("allow-duplicates", false, "warn rather than fail when migrations share a version")
+var flagAllowMissing = flag.Bool("allow-missing", false, "apply, rather than fail on, unapplied migrations older than the current version")
+var flagBatch = flag.Bool("batch", false, "run the pending SQL migrations in one transaction, each within a savepoint")
+var flagDryRun = flag.Bool("dry-run", false, "print the SQL that would be run, rather than running it")
+var flagFake = flag.Bool("fake", false, "record migrations as applied or rolled back without running them")
+var flagNoVersioning = flag.Bool("no-versioning", false, "run every SQL migration's Up statements without reading or writing the version table")
+var flagRetries = flag.Int("retries", 0, "retry SQL migrations that fail with a transient error, such as a deadlock, this many times")
+var flagIgnoreChecksums = flag.Bool("ignore-checksums", false, "don't fail when an applied migration has been edited")
+var flagExpandEnv = flag.Bool("expand-env", false, "expand $VAR and ${VAR} in SQL migrations from the environment")
+var flagGoPlugin = flag.String("go-plugin", "", "Go plugin (.so) providing Go migrations to run in-process")
+var flagGoCommand = flag.String("go", "", "go command to run Go migrations with (default = go on the PATH)")
+var flagSkipGo = flag.Bool("skip-go", false, "leave Go migrations that would be run via go run alone, e.g. where there's no Go toolchain")
+var flagGoFlags = flag.String("go-flags", "", "flags for go run of Go migrations, e.g. \"-mod=mod -tags=ci\"")
+var flagTemplateData = flag.String("template-data", "", "JSON file of the data that SQL migrations annotated TEMPLATE are executed with")
+var flagVerbose = flag.Bool("v", false, "log each SQL statement as it's run, and how long each migration took")
+var flagStrictEnv = flag.Bool("strict-env", false, "fail when a variable expanded in dbconf.yml or a migration isn't set")
+var flagVersion = flag.Bool("version", false, "print the version of goose, and exit")
 
 // helper to create a DBConf from the given flags
 func dbConfFromFlags() (dbconf *goose.DBConf, err error) {
-	return goose.NewDBConf(*flagPath, *flagEnv, *flagPgSchema)
+	if *flagURL != "" {
+		dbconf, err = goose.NewDBConfFromURL(*flagURL)
+		if err != nil {
+			return nil, err
+		}
+		dbconf.MigrationsDir = filepath.Join(*flagPath, "migrations")
+		dbconf.Env = "url"
+		dbconf.PgSchema = *flagPgSchema
+		dbconf.StrictEnv = *flagStrictEnv
+	} else {
+		dbconf, err = goose.LoadDBConf(*flagPath, *flagEnv, *flagPgSchema, *flagStrictEnv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dbconf.AllowDuplicateVersions = *flagAllowDuplicates
+	dbconf.AllowMissing = *flagAllowMissing
+	dbconf.DryRun = *flagDryRun
+	dbconf.Batch = dbconf.Batch || *flagBatch
+	dbconf.Fake = *flagFake
+	dbconf.NoVersioning = *flagNoVersioning
+	dbconf.Retries = *flagRetries
+	dbconf.IgnoreChecksums = *flagIgnoreChecksums
+	dbconf.ExpandEnv = *flagExpandEnv
+	dbconf.GoPlugin = *flagGoPlugin
+	dbconf.GoCommand = *flagGoCommand
+	dbconf.GoRunFlags = strings.Fields(*flagGoFlags)
+	dbconf.SkipGo = *flagSkipGo
+	dbconf.Verbose = *flagVerbose
+
+	if *flagTemplateData != "" {
+		b, err := os.ReadFile(*flagTemplateData)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(b, &dbconf.TemplateData); err != nil {
+			return nil, fmt.Errorf("%s: %w", *flagTemplateData, err)
+		}
+	}
+
+	return dbconf, nil
 }
 
 var commands = []*Command{
 	upCmd,
+	upToCmd,
 	downCmd,
+	downToCmd,
 	redoCmd,
+	resetCmd,
 	statusCmd,
 	createCmd,
 	dbVersionCmd,
+	validateCmd,
+	baselineCmd,
+	fixCmd,
+	orphansCmd,
+	preflightCmd,
+	nextVersionCmd,
 }
 
 func main() {
@@ -33,6 +103,11 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
+	if *flagVersion {
+		fmt.Printf("goose %s\n", goose.Version())
+		return
+	}
+
 	args := flag.Args()
 	if len(args) == 0 || args[0] == "-h" {
 		flag.Usage()
@@ -2,117 +2,1348 @@ package goose
 
 import (
 	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
 )
 
 // SqlDialect abstracts the details of specific SQL dialects
-// for goose's few SQL specific statements
+// for goose's few SQL specific statements.
+//
+// Dialects for other databases may be implemented outside of
+// goose and made available via RegisterDialect.
 type SqlDialect interface {
-	createVersionTableSql() string // sql string to create the goose_db_version table
-	insertVersionSql() string      // sql string to insert the initial version table row
-	dbVersionQuery(db *sql.DB) (*sql.Rows, error)
+	CreateVersionTableSql(table string) string // sql string to create the version table
+	InsertVersionSql(table string) string      // sql string to insert a version table row: version_id, is_applied, checksum, duration_ms
+	DeleteVersionSql(table string) string      // sql string to delete every version table row for a version_id
+	// sql expression for the current time, for the version table's
+	// tstamp, in UTC where the column type doesn't keep a time zone
+	NowSql() string
+	// does the table, which may be schema qualified, exist?
+	TableExists(db *sql.DB, table string) (bool, error)
+	// query the version_id and is_applied of each row of the version table,
+	// newest first. goose checks the table exists before querying it.
+	DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error)
+	// query the version_id, is_applied, tstamp, as seconds since the
+	// unix epoch, and duration_ms of each row of the version table,
+	// oldest first.
+	VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error)
+	// query the version_id, is_applied and checksum of each row of
+	// the version table, oldest first
+	ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error)
+	// does the version table, which may be schema qualified, have
+	// the named column? like TableExists, it's given the bare name,
+	// and should look the column up in the database's catalog
+	ColumnExists(db *sql.DB, table, column string) (bool, error)
+	// sql string to take a session lock, named after the version
+	// table, for the migration run, or "" if unsupported
+	LockSql(table string) string
+	UnlockSql(table string) string // sql string to release the lock taken by LockSql
+	// sql string to add a column missing from a version table
+	// created by an older goose
+	AddColumnSql(table, name, sqlType string) string
+	// quote an identifier in goose's own SQL, such as the version
+	// table's name, e.g. with ANSI double quotes or backticks
+	QuoteIdentifier(name string) string
 }
 
-// drivers that we don't know about can ask for a dialect by name
-func dialectByName(d string) SqlDialect {
-	switch d {
-	case "postgres":
-		return &PostgresDialect{}
-	case "mysql":
-		return &MySqlDialect{}
-	case "sqlite3":
-		return &Sqlite3Dialect{}
+// the version table's name, unless DBConf.VersionTable says otherwise
+const defaultVersionTable = "goose_db_version"
+
+// version table names may be schema qualified, but are
+// otherwise limited to plain identifiers, since they're
+// interpolated into goose's SQL as they are
+var versionTableRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func validateVersionTable(table string) error {
+	if !versionTableRegexp.MatchString(table) {
+		return fmt.Errorf("%q is not a valid version table name", table)
+	}
+	return nil
+}
+
+// dialects for databases without transactions implement
+// transactionless, and have their SQL migrations run as if
+// annotated NO TRANSACTION
+type transactionless interface {
+	NoTransactions() bool
+}
+
+func noTransactions(d SqlDialect) bool {
+	t, ok := d.(transactionless)
+	return ok && t.NoTransactions()
+}
+
+// should a SQL migration whose annotations ask for a transaction,
+// or not, per useTx, be run in one?
+func runInTransaction(conf *DBConf, useTx bool) bool {
+	return useTx && !conf.NoTransactions && !noTransactions(conf.Driver.Dialect)
+}
+
+// dialects for databases that implicitly commit any transaction
+// open when DDL is executed, such as mysql, implement ddlCommitter,
+// so that a migration that fails part way can be reported as
+// having been partly applied
+type ddlCommitter interface {
+	CommitsDDL() bool
+}
+
+func commitsDDL(d SqlDialect) bool {
+	c, ok := d.(ddlCommitter)
+	return ok && c.CommitsDDL()
+}
+
+// dialects that can tell transient errors, such as deadlocks, which
+// may well succeed if retried, from any others implement retrier
+type retrier interface {
+	IsRetryable(err error) bool
+}
+
+func isRetryable(d SqlDialect, err error) bool {
+	r, ok := d.(retrier)
+	return ok && r.IsRetryable(err)
+}
+
+// dialects whose transactions can be rolled back part way implement
+// savepointer, so that DBConf.Batch can run each migration of a batch
+// within a savepoint of its own
+type savepointer interface {
+	SavepointSql(name string) string
+	RollbackToSavepointSql(name string) string
+}
+
+// the SQLSTATE of an error from a driver that reports it,
+// such as lib/pq or pgx, or "" if there isn't one
+func sqlState(err error) string {
+	var s interface{ SQLState() string }
+	if errors.As(err, &s) {
+		return s.SQLState()
+	}
+	return ""
+}
+
+// dialects for databases without a boolean type, such as oracle,
+// implement boolEncoder to say how is_applied is to be written
+type boolEncoder interface {
+	EncodeBool(b bool) interface{}
+}
+
+func encodeBool(d SqlDialect, b bool) interface{} {
+	if e, ok := d.(boolEncoder); ok {
+		return e.EncodeBool(b)
+	}
+	return b
+}
+
+// dialects whose drivers won't take statements as they're written in
+// SQL migrations, such as oracle's, which reject a trailing semicolon,
+// implement statementTrimmer to fix them up before they're executed
+type statementTrimmer interface {
+	TrimStatement(stmt string) string
+}
+
+func trimStatements(d SqlDialect, stmts []string) []string {
+	t, ok := d.(statementTrimmer)
+	if !ok {
+		return stmts
+	}
+
+	trimmed := make([]string, len(stmts))
+	for i, stmt := range stmts {
+		trimmed[i] = t.TrimStatement(stmt)
+	}
+	return trimmed
+}
+
+// dialects whose version table has a metadata column, as do those of
+// all the databases goose supports, implement metadataStore, so that
+// registered Go migrations can keep metadata for rolling them back
+type metadataStore interface {
+	// sql string to insert a version table row:
+	// version_id, is_applied, checksum, duration_ms, metadata
+	InsertVersionMetadataSql(table string) string
+	// query the is_applied and metadata of each row of
+	// the version table for version, newest first
+	VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error)
+}
+
+// dialects whose inserts can return the id of the row they insert,
+// such as postgres with RETURNING, implement idReturner, so that
+// the id of each version table row can be given to DBConf.AfterRecord
+type idReturner interface {
+	// the version table insert, insert, made to return the row's id
+	ReturningId(insert string) string
+}
+
+// dialects that can describe the schema of a database implement
+// schemaDumper, so that CheckDownMigrationsOnDb can tell whether
+// a Down migration restored the schema its Up changed
+type schemaDumper interface {
+	// describe each table, column, index and so on in the schema
+	// goose migrates, one per line, in an order that's stable
+	DumpSchema(db *sql.DB) ([]string, error)
+}
+
+// run a query for DumpSchema, returning each row as a line
+// of its columns, which must all be text, separated by spaces
+func querySchemaLines(db *sql.DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for rows.Next() {
+		vals := make([]string, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.Join(vals, " "))
+	}
+
+	return lines, rows.Err()
+}
+
+// the relations, columns and index definitions of the
+// current schema of postgres, and databases like it
+const pgDumpSchemaSql = `SELECT 'relation', c.relkind::text, c.relname, ''
+    FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE n.nspname = current_schema()
+UNION ALL
+SELECT 'column', table_name::text, column_name::text, data_type || ' ' || is_nullable || ' ' || COALESCE(column_default, '')
+    FROM information_schema.columns
+    WHERE table_schema = current_schema()
+UNION ALL
+SELECT 'index', tablename::text, indexname::text, indexdef
+    FROM pg_indexes
+    WHERE schemaname = current_schema()
+ORDER BY 1, 2, 3, 4`
+
+// quote a possibly schema qualified table name
+func quoteTableName(d SqlDialect, table string) string {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		return d.QuoteIdentifier(name)
 	}
+	return d.QuoteIdentifier(schema) + "." + d.QuoteIdentifier(name)
+}
+
+// split a possibly schema qualified table name,
+// with an empty schema if it isn't qualified
+func splitTableName(table string) (schema, name string) {
+	if i := strings.Index(table, "."); i >= 0 {
+		return table[:i], table[i+1:]
+	}
+	return "", table
+}
+
+// run a query counting the rows matching a table, or a column,
+// for TableExists and ColumnExists
+func queryTableExists(db *sql.DB, query string, args ...interface{}) (bool, error) {
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// PlaceholderStyle is how a query's parameters are written,
+// which is up to the database/sql driver rather than the database.
+type PlaceholderStyle string
+
+const (
+	DollarPlaceholders   PlaceholderStyle = "dollar"   // $1, $2, ...: lib/pq, pgx
+	QuestionPlaceholders PlaceholderStyle = "question" // ?, ?, ...: mysql, sqlite3
+	AtPlaceholders       PlaceholderStyle = "at"       // @p1, @p2, ...: go-mssqldb
+	ColonPlaceholders    PlaceholderStyle = "colon"    // :1, :2, ...: godror, go-ora
+)
+
+// the placeholder style expected by each database/sql driver, by
+// name, for drivers used with a dialect other than their own
+var driverPlaceholders = map[string]PlaceholderStyle{
+	"postgres":   DollarPlaceholders,
+	"pgx":        DollarPlaceholders,
+	"mysql":      QuestionPlaceholders,
+	"mymysql":    QuestionPlaceholders,
+	"sqlite3":    QuestionPlaceholders,
+	"sqlite":     QuestionPlaceholders,
+	"mssql":      AtPlaceholders,
+	"sqlserver":  AtPlaceholders,
+	"clickhouse": QuestionPlaceholders,
+	"godror":     ColonPlaceholders,
+	"oracle":     ColonPlaceholders,
+}
+
+// the nth placeholder, counting from 1, in style p,
+// or in style def if p isn't set
+func (p PlaceholderStyle) placeholder(def PlaceholderStyle, n int) string {
+	if p == "" {
+		p = def
+	}
+	switch p {
+	case DollarPlaceholders:
+		return fmt.Sprintf("$%d", n)
+	case AtPlaceholders:
+		return fmt.Sprintf("@p%d", n)
+	case ColonPlaceholders:
+		return fmt.Sprintf(":%d", n)
+	}
+	return "?"
+}
+
+// placeholders 1 to n, comma separated
+func (p PlaceholderStyle) placeholders(def PlaceholderStyle, n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = p.placeholder(def, i+1)
+	}
+	return strings.Join(ps, ", ")
+}
+
+// WithPlaceholders returns a copy of the dialect that writes
+// placeholders in the given style, for use with a driver other than
+// the one it usually goes with. Dialects support this by having a
+// Placeholders field of type PlaceholderStyle, as the built in
+// dialects do.
+func WithPlaceholders(d SqlDialect, style PlaceholderStyle) (SqlDialect, error) {
+
+	switch style {
+	case DollarPlaceholders, QuestionPlaceholders, AtPlaceholders, ColonPlaceholders:
+	default:
+		return nil, fmt.Errorf("%q: unknown placeholder style", style)
+	}
+
+	v := reflect.ValueOf(d)
+	ptr := v.Kind() == reflect.Ptr
+	if ptr {
+		v = v.Elem()
+	}
+
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+
+	f := c.FieldByName("Placeholders")
+	if !f.IsValid() || f.Type() != reflect.TypeOf(style) {
+		return nil, fmt.Errorf("dialect %T doesn't support placeholder styles", d)
+	}
+	f.Set(reflect.ValueOf(style))
 
+	if ptr {
+		return c.Addr().Interface().(SqlDialect), nil
+	}
+	return c.Interface().(SqlDialect), nil
+}
+
+// key of the advisory lock taken by postgres while migrating
+// the default version table, arbitrary but specific to goose
+const pgAdvisoryLockKey = 1194512537
+
+// key of the advisory lock taken by postgres while migrating the
+// given version table: a hash of its name, as folded by postgres,
+// other than for the default table, which keeps the key older
+// gooses lock it with
+func pgAdvisoryLockKeyFor(table string) int64 {
+	table = strings.ToLower(table)
+	if table == defaultVersionTable {
+		return pgAdvisoryLockKey
+	}
+	h := fnv.New64a()
+	h.Write([]byte(table))
+	return int64(h.Sum64())
+}
+
+// the dialect used by the in-process API, such as Up()
+var defaultDialect SqlDialect = &PostgresDialect{}
+
+// SetDialect selects the dialect used by the in-process API.
+// The default is postgres.
+func SetDialect(d string) error {
+	dialect := DialectByName(d)
+	if dialect == nil {
+		return fmt.Errorf("%q: unknown dialect", d)
+	}
+
+	defaultDialect = dialect
 	return nil
 }
 
+// registered dialects, by name, and their names in
+// the order they were registered
+var (
+	dialects     = map[string]SqlDialect{}
+	dialectNames []string
+)
+
+func init() {
+	RegisterDialect("postgres", &PostgresDialect{})
+	RegisterDialect("mysql", &MySqlDialect{})
+	RegisterDialect("mariadb", &MariaDBDialect{})
+	RegisterDialect("sqlite3", &Sqlite3Dialect{})
+	RegisterDialect("cockroach", &CockroachDialect{})
+	RegisterDialect("redshift", &RedshiftDialect{})
+	RegisterDialect("mssql", &SqlServerDialect{})
+	RegisterDialect("clickhouse", &ClickHouseDialect{})
+	RegisterDialect("oracle", &OracleDialect{})
+}
+
+// RegisterDialect makes the dialect available by name, to
+// DialectByName, SetDialect and the dialect element of dbconf.yml.
+// Registering a name again replaces its dialect.
+//
+// The dialect's type is also registered with encoding/gob, so a
+// type must always be registered as either a value or a pointer.
+//
+// Go migrations run via `go run` look up the dialect by name in
+// a process of their own, so a dialect that they use must also
+// be registered from the init() of one of the migrations.
+func RegisterDialect(name string, d SqlDialect) {
+	if _, ok := dialects[name]; !ok {
+		dialectNames = append(dialectNames, name)
+	}
+	dialects[name] = d
+	gob.Register(d)
+}
+
+// Dialects returns the names of the registered dialects, those
+// built in and any registered via RegisterDialect, in the order
+// they were registered.
+func Dialects() []string {
+	return append([]string(nil), dialectNames...)
+}
+
+// drivers that we don't know about can ask for a dialect by name.
+// returns nil if the name isn't one that we know about.
+func DialectByName(d string) SqlDialect {
+	return dialects[d]
+}
+
+// the dialects of the drivers that goose recognizes,
+// keyed by the package path of their driver.Driver
+var driverPackageDialects = map[string]string{
+	"github.com/lib/pq":                      "postgres",
+	"github.com/jackc/pgx/v4/stdlib":         "postgres",
+	"github.com/jackc/pgx/v5/stdlib":         "postgres",
+	"github.com/go-sql-driver/mysql":         "mysql",
+	"github.com/ziutek/mymysql/godrv":        "mysql",
+	"github.com/mattn/go-sqlite3":            "sqlite3",
+	"modernc.org/sqlite":                     "sqlite3",
+	"github.com/denisenkom/go-mssqldb":       "mssql",
+	"github.com/microsoft/go-mssqldb":        "mssql",
+	"github.com/ClickHouse/clickhouse-go/v2": "clickhouse",
+	"github.com/godror/godror":               "oracle",
+	"github.com/sijms/go-ora/v2":             "oracle",
+}
+
+// DialectForDB infers the dialect of an already open db from its
+// driver. Databases that speak another's protocol, such as cockroach
+// via lib/pq, get the dialect of the protocol's usual database.
+func DialectForDB(db *sql.DB) (SqlDialect, error) {
+	pkg := indirectType(reflect.TypeOf(db.Driver())).PkgPath()
+	name, ok := driverPackageDialects[pkg]
+	if !ok {
+		return nil, fmt.Errorf("can't infer a dialect for the driver from %q", pkg)
+	}
+	return DialectByName(name), nil
+}
+
+// dialectName is the inverse of DialectByName, so that the dialect
+// can be reconstructed on the far side of a `go run` migration.
+// a dialect registered under more than one name gets the first.
+func dialectName(d SqlDialect) string {
+	t := indirectType(reflect.TypeOf(d))
+	for _, name := range dialectNames {
+		if indirectType(reflect.TypeOf(dialects[name])) == t {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// dialects are matched whether they're values or pointers
+func indirectType(t reflect.Type) reflect.Type {
+	if t != nil && t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
 ////////////////////////////
 // Postgres
 ////////////////////////////
 
-type PostgresDialect struct{}
+type PostgresDialect struct {
+	// placeholder style of the driver, DollarPlaceholders if it's not set
+	Placeholders PlaceholderStyle
+}
 
-func (pg PostgresDialect) createVersionTableSql() string {
-	return `CREATE TABLE goose_db_version (
+func (pg PostgresDialect) CreateVersionTableSql(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
             	id serial NOT NULL,
                 version_id bigint NOT NULL,
                 is_applied boolean NOT NULL,
-                tstamp timestamp NULL default now(),
+                tstamp timestamp NULL default %s,
+                checksum varchar(64) NULL,
+                duration_ms bigint NULL,
+                metadata text NULL,
                 PRIMARY KEY(id)
-            );`
+            );`, table, pg.NowSql())
 }
 
-func (pg PostgresDialect) insertVersionSql() string {
-	return "INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, $2);"
+func (pg PostgresDialect) InsertVersionSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, tstamp) VALUES (%s, %s);", table, pg.Placeholders.placeholders(DollarPlaceholders, 4), pg.NowSql())
 }
 
-func (pg PostgresDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query("SELECT version_id, is_applied from goose_db_version ORDER BY id DESC")
+func (pg PostgresDialect) InsertVersionMetadataSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, metadata, tstamp) VALUES (%s, %s);", table, pg.Placeholders.placeholders(DollarPlaceholders, 5), pg.NowSql())
+}
 
-	// XXX: check for postgres specific error indicating the table doesn't exist.
-	// for now, assume any error is because the table doesn't exist,
-	// in which case we'll try to create it.
-	if err != nil {
-		return nil, ErrTableDoesNotExist
-	}
+func (pg PostgresDialect) DeleteVersionSql(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = %s;", table, pg.Placeholders.placeholder(DollarPlaceholders, 1))
+}
+
+// timestamp columns have no time zone, so are given the time in UTC
+func (pg PostgresDialect) NowSql() string {
+	return "(now() AT TIME ZONE 'UTC')"
+}
+
+// unquoted identifiers are folded to lower case by postgres
+func (pg PostgresDialect) TableExists(db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(strings.ToLower(table))
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = COALESCE(NULLIF(%s, ''), current_schema()) AND table_name = %s",
+		pg.Placeholders.placeholder(DollarPlaceholders, 1), pg.Placeholders.placeholder(DollarPlaceholders, 2)), schema, name)
+}
+
+func (pg PostgresDialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	schema, name := splitTableName(strings.ToLower(table))
+	column = strings.ToLower(column)
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = COALESCE(NULLIF(%s, ''), current_schema()) AND table_name = %s AND column_name = %s",
+		pg.Placeholders.placeholder(DollarPlaceholders, 1), pg.Placeholders.placeholder(DollarPlaceholders, 2), pg.Placeholders.placeholder(DollarPlaceholders, 3)), schema, name, column)
+}
+
+func (pg PostgresDialect) DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", table))
+}
+
+func (pg PostgresDialect) VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, CAST(EXTRACT(EPOCH FROM tstamp) AS BIGINT), duration_ms FROM %s ORDER BY id", table))
+}
+
+func (pg PostgresDialect) ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY id", table))
+}
+
+func (pg PostgresDialect) VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT is_applied, metadata FROM %s WHERE version_id = %s ORDER BY id DESC", table, pg.Placeholders.placeholder(DollarPlaceholders, 1)), version)
+}
+
+func (pg PostgresDialect) LockSql(table string) string {
+	return fmt.Sprintf("SELECT pg_advisory_lock(%d);", pgAdvisoryLockKeyFor(table))
+}
 
-	return rows, err
+func (pg PostgresDialect) UnlockSql(table string) string {
+	return fmt.Sprintf("SELECT pg_advisory_unlock(%d);", pgAdvisoryLockKeyFor(table))
+}
+
+func (pg PostgresDialect) AddColumnSql(table, name, sqlType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s NULL;", table, name, sqlType)
+}
+
+func (pg PostgresDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (pg PostgresDialect) DumpSchema(db *sql.DB) ([]string, error) {
+	return querySchemaLines(db, pgDumpSchemaSql)
+}
+
+func (pg PostgresDialect) ReturningId(insert string) string {
+	return strings.TrimSuffix(insert, ";") + " RETURNING id;"
+}
+
+// serialization_failure and deadlock_detected
+func (pg PostgresDialect) IsRetryable(err error) bool {
+	state := sqlState(err)
+	return state == "40001" || state == "40P01"
+}
+
+func (pg PostgresDialect) SavepointSql(name string) string {
+	return fmt.Sprintf("SAVEPOINT %s;", name)
+}
+
+func (pg PostgresDialect) RollbackToSavepointSql(name string) string {
+	return fmt.Sprintf("ROLLBACK TO SAVEPOINT %s;", name)
 }
 
 ////////////////////////////
 // MySQL
 ////////////////////////////
 
-type MySqlDialect struct{}
+type MySqlDialect struct {
+	// placeholder style of the driver, QuestionPlaceholders if it's not set
+	Placeholders PlaceholderStyle
+}
 
-func (m MySqlDialect) createVersionTableSql() string {
-	return `CREATE TABLE goose_db_version (
+func (m MySqlDialect) CreateVersionTableSql(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
                 id serial NOT NULL,
                 version_id bigint NOT NULL,
                 is_applied boolean NOT NULL,
-                tstamp timestamp NULL default now(),
+                tstamp timestamp NULL default %s,
+                checksum varchar(64) NULL,
+                duration_ms bigint NULL,
+                metadata text NULL,
                 PRIMARY KEY(id)
-            );`
+            );`, table, m.NowSql())
 }
 
-func (m MySqlDialect) insertVersionSql() string {
-	return "INSERT INTO goose_db_version (version_id, is_applied) VALUES (?, ?);"
+func (m MySqlDialect) InsertVersionSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, tstamp) VALUES (%s, %s);", table, m.Placeholders.placeholders(QuestionPlaceholders, 4), m.NowSql())
 }
 
-func (m MySqlDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query("SELECT version_id, is_applied from goose_db_version ORDER BY id DESC")
+func (m MySqlDialect) InsertVersionMetadataSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, metadata, tstamp) VALUES (%s, %s);", table, m.Placeholders.placeholders(QuestionPlaceholders, 5), m.NowSql())
+}
 
-	// XXX: check for mysql specific error indicating the table doesn't exist.
-	// for now, assume any error is because the table doesn't exist,
-	// in which case we'll try to create it.
-	if err != nil {
-		return nil, ErrTableDoesNotExist
-	}
+func (m MySqlDialect) DeleteVersionSql(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = %s;", table, m.Placeholders.placeholder(QuestionPlaceholders, 1))
+}
+
+// timestamp columns are converted to UTC from the session's time zone
+func (m MySqlDialect) NowSql() string {
+	return "CURRENT_TIMESTAMP"
+}
+
+// a schema in mysql is a database
+func (m MySqlDialect) TableExists(db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(table)
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = COALESCE(NULLIF(%s, ''), DATABASE()) AND table_name = %s",
+		m.Placeholders.placeholder(QuestionPlaceholders, 1), m.Placeholders.placeholder(QuestionPlaceholders, 2)), schema, name)
+}
+
+func (m MySqlDialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	schema, name := splitTableName(table)
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = COALESCE(NULLIF(%s, ''), DATABASE()) AND table_name = %s AND column_name = %s",
+		m.Placeholders.placeholder(QuestionPlaceholders, 1), m.Placeholders.placeholder(QuestionPlaceholders, 2), m.Placeholders.placeholder(QuestionPlaceholders, 3)), schema, name, column)
+}
+
+func (m MySqlDialect) DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", table))
+}
 
-	return rows, err
+func (m MySqlDialect) VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, UNIX_TIMESTAMP(tstamp), duration_ms FROM %s ORDER BY id", table))
+}
+
+func (m MySqlDialect) ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY id", table))
+}
+
+func (m MySqlDialect) VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT is_applied, metadata FROM %s WHERE version_id = %s ORDER BY id DESC", table, m.Placeholders.placeholder(QuestionPlaceholders, 1)), version)
+}
+
+// a negative timeout waits for the lock indefinitely
+func (m MySqlDialect) LockSql(table string) string {
+	return fmt.Sprintf("SELECT GET_LOCK('%s', -1);", table)
+}
+
+func (m MySqlDialect) UnlockSql(table string) string {
+	return fmt.Sprintf("SELECT RELEASE_LOCK('%s');", table)
+}
+
+func (m MySqlDialect) AddColumnSql(table, name, sqlType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s NULL;", table, name, sqlType)
+}
+
+func (m MySqlDialect) QuoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// mysql commits before and after each DDL statement,
+// whether or not a transaction is open
+func (m MySqlDialect) CommitsDDL() bool {
+	return true
+}
+
+// deadlocks (1213) and lock wait timeouts (1205), as go-sql-driver/mysql
+// reports them, e.g. "Error 1213 (40001): Deadlock found when trying to get lock"
+func (m MySqlDialect) IsRetryable(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Error 1213") || strings.Contains(msg, "Error 1205")
+}
+
+////////////////////////////
+// MariaDB
+////////////////////////////
+
+// MariaDBDialect is MySqlDialect, except where MariaDB differs
+type MariaDBDialect struct {
+	MySqlDialect
+}
+
+// mariadb can skip a column that's already there, so an upgrade
+// of the version table interrupted part way can simply be re-run
+func (m MariaDBDialect) AddColumnSql(table, name, sqlType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s NULL;", table, name, sqlType)
 }
 
 ////////////////////////////
 // sqlite3
 ////////////////////////////
 
-type Sqlite3Dialect struct{}
+type Sqlite3Dialect struct {
+	// placeholder style of the driver, QuestionPlaceholders if it's not set
+	Placeholders PlaceholderStyle
+}
 
-func (m Sqlite3Dialect) createVersionTableSql() string {
-	return `CREATE TABLE goose_db_version (
+func (m Sqlite3Dialect) CreateVersionTableSql(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
                 id INTEGER PRIMARY KEY AUTOINCREMENT,
                 version_id INTEGER NOT NULL,
                 is_applied INTEGER NOT NULL,
-                tstamp TIMESTAMP DEFAULT (datetime('now'))
-            );`
+                tstamp TIMESTAMP DEFAULT (%s),
+                checksum TEXT NULL,
+                duration_ms INTEGER NULL,
+                metadata TEXT NULL
+            );`, table, m.NowSql())
+}
+
+func (m Sqlite3Dialect) InsertVersionSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, tstamp) VALUES (%s, %s);", table, m.Placeholders.placeholders(QuestionPlaceholders, 4), m.NowSql())
+}
+
+func (m Sqlite3Dialect) InsertVersionMetadataSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, metadata, tstamp) VALUES (%s, %s);", table, m.Placeholders.placeholders(QuestionPlaceholders, 5), m.NowSql())
+}
+
+func (m Sqlite3Dialect) DeleteVersionSql(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = %s;", table, m.Placeholders.placeholder(QuestionPlaceholders, 1))
+}
+
+// datetime('now') is in UTC
+func (m Sqlite3Dialect) NowSql() string {
+	return "datetime('now')"
+}
+
+// a schema in sqlite3 is an attached database, with its own sqlite_master
+func (m Sqlite3Dialect) TableExists(db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(table)
+	master := "sqlite_master"
+	if schema != "" {
+		master = schema + ".sqlite_master"
+	}
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE type = 'table' AND name = %s",
+		master, m.Placeholders.placeholder(QuestionPlaceholders, 1)), name)
+}
+
+func (m Sqlite3Dialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	schema, name := splitTableName(table)
+	if schema == "" {
+		schema = "main"
+	}
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info(%s, %s) WHERE name = %s",
+		m.Placeholders.placeholder(QuestionPlaceholders, 1), m.Placeholders.placeholder(QuestionPlaceholders, 2), m.Placeholders.placeholder(QuestionPlaceholders, 3)), name, schema, column)
+}
+
+func (m Sqlite3Dialect) DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", table))
+}
+
+func (m Sqlite3Dialect) VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, CAST(strftime('%%s', tstamp) AS INTEGER), duration_ms FROM %s ORDER BY id", table))
+}
+
+func (m Sqlite3Dialect) ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY id", table))
+}
+
+func (m Sqlite3Dialect) VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT is_applied, metadata FROM %s WHERE version_id = %s ORDER BY id DESC", table, m.Placeholders.placeholder(QuestionPlaceholders, 1)), version)
+}
+
+// sqlite3 serializes writers to the database file already
+func (m Sqlite3Dialect) LockSql(table string) string {
+	return ""
+}
+
+func (m Sqlite3Dialect) UnlockSql(table string) string {
+	return ""
+}
+
+func (m Sqlite3Dialect) AddColumnSql(table, name, sqlType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s NULL;", table, name, sqlType)
+}
+
+func (m Sqlite3Dialect) SavepointSql(name string) string {
+	return fmt.Sprintf("SAVEPOINT %s;", name)
+}
+
+func (m Sqlite3Dialect) RollbackToSavepointSql(name string) string {
+	return fmt.Sprintf("ROLLBACK TO SAVEPOINT %s;", name)
+}
+
+func (m Sqlite3Dialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// the statements that created each table, index, view and trigger
+func (m Sqlite3Dialect) DumpSchema(db *sql.DB) ([]string, error) {
+	return querySchemaLines(db, "SELECT type, name, COALESCE(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name")
+}
+
+////////////////////////////
+// CockroachDB
+////////////////////////////
+
+type CockroachDialect struct {
+	// placeholder style of the driver, DollarPlaceholders if it's not set
+	Placeholders PlaceholderStyle
+}
+
+func (c CockroachDialect) CreateVersionTableSql(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id INT8 NOT NULL DEFAULT unique_rowid(),
+                version_id INT8 NOT NULL,
+                is_applied BOOL NOT NULL,
+                tstamp TIMESTAMP NULL DEFAULT %s,
+                checksum VARCHAR(64) NULL,
+                duration_ms BIGINT NULL,
+                metadata STRING NULL,
+                PRIMARY KEY(id)
+            );`, table, c.NowSql())
+}
+
+func (c CockroachDialect) InsertVersionSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, tstamp) VALUES (%s, %s);", table, c.Placeholders.placeholders(DollarPlaceholders, 4), c.NowSql())
+}
+
+func (c CockroachDialect) InsertVersionMetadataSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, metadata, tstamp) VALUES (%s, %s);", table, c.Placeholders.placeholders(DollarPlaceholders, 5), c.NowSql())
+}
+
+func (c CockroachDialect) DeleteVersionSql(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = %s;", table, c.Placeholders.placeholder(DollarPlaceholders, 1))
+}
+
+// as for postgres
+func (c CockroachDialect) NowSql() string {
+	return "(now() AT TIME ZONE 'UTC')"
+}
+
+func (c CockroachDialect) TableExists(db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(strings.ToLower(table))
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = COALESCE(NULLIF(%s, ''), current_schema()) AND table_name = %s",
+		c.Placeholders.placeholder(DollarPlaceholders, 1), c.Placeholders.placeholder(DollarPlaceholders, 2)), schema, name)
+}
+
+func (c CockroachDialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	schema, name := splitTableName(strings.ToLower(table))
+	column = strings.ToLower(column)
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = COALESCE(NULLIF(%s, ''), current_schema()) AND table_name = %s AND column_name = %s",
+		c.Placeholders.placeholder(DollarPlaceholders, 1), c.Placeholders.placeholder(DollarPlaceholders, 2), c.Placeholders.placeholder(DollarPlaceholders, 3)), schema, name, column)
+}
+
+func (c CockroachDialect) DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", table))
+}
+
+func (c CockroachDialect) VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, CAST(EXTRACT(EPOCH FROM tstamp) AS INT8), duration_ms FROM %s ORDER BY id", table))
+}
+
+func (c CockroachDialect) ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY id", table))
+}
+
+func (c CockroachDialect) VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT is_applied, metadata FROM %s WHERE version_id = %s ORDER BY id DESC", table, c.Placeholders.placeholder(DollarPlaceholders, 1)), version)
+}
+
+// cockroach accepts pg_advisory_lock, but it doesn't actually lock
+func (c CockroachDialect) LockSql(table string) string {
+	return ""
+}
+
+func (c CockroachDialect) UnlockSql(table string) string {
+	return ""
+}
+
+func (c CockroachDialect) AddColumnSql(table, name, sqlType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s NULL;", table, name, sqlType)
+}
+
+func (c CockroachDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (c CockroachDialect) ReturningId(insert string) string {
+	return strings.TrimSuffix(insert, ";") + " RETURNING id;"
+}
+
+// cockroach asks clients to retry transactions that
+// conflicted with another via serialization_failure
+func (c CockroachDialect) IsRetryable(err error) bool {
+	return sqlState(err) == "40001"
+}
+
+func (c CockroachDialect) SavepointSql(name string) string {
+	return fmt.Sprintf("SAVEPOINT %s;", name)
+}
+
+func (c CockroachDialect) RollbackToSavepointSql(name string) string {
+	return fmt.Sprintf("ROLLBACK TO SAVEPOINT %s;", name)
+}
+
+////////////////////////////
+// Redshift
+////////////////////////////
+
+type RedshiftDialect struct {
+	// placeholder style of the driver, DollarPlaceholders if it's not set
+	Placeholders PlaceholderStyle
+}
+
+// redshift has no serial, and a TEXT column is only a VARCHAR(256)
+func (r RedshiftDialect) CreateVersionTableSql(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id BIGINT IDENTITY(1,1) NOT NULL,
+                version_id BIGINT NOT NULL,
+                is_applied BOOLEAN NOT NULL,
+                tstamp TIMESTAMP NULL DEFAULT %s,
+                checksum VARCHAR(64) NULL,
+                duration_ms BIGINT NULL,
+                metadata VARCHAR(65535) NULL,
+                PRIMARY KEY(id)
+            );`, table, r.NowSql())
+}
+
+func (r RedshiftDialect) InsertVersionSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, tstamp) VALUES (%s, %s);", table, r.Placeholders.placeholders(DollarPlaceholders, 4), r.NowSql())
+}
+
+func (r RedshiftDialect) InsertVersionMetadataSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, metadata, tstamp) VALUES (%s, %s);", table, r.Placeholders.placeholders(DollarPlaceholders, 5), r.NowSql())
+}
+
+func (r RedshiftDialect) DeleteVersionSql(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = %s;", table, r.Placeholders.placeholder(DollarPlaceholders, 1))
+}
+
+// the time in the session's time zone, which is UTC unless set otherwise
+func (r RedshiftDialect) NowSql() string {
+	return "GETDATE()"
+}
+
+func (r RedshiftDialect) TableExists(db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(strings.ToLower(table))
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = COALESCE(NULLIF(%s, ''), current_schema()) AND table_name = %s",
+		r.Placeholders.placeholder(DollarPlaceholders, 1), r.Placeholders.placeholder(DollarPlaceholders, 2)), schema, name)
+}
+
+func (r RedshiftDialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	schema, name := splitTableName(strings.ToLower(table))
+	column = strings.ToLower(column)
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = COALESCE(NULLIF(%s, ''), current_schema()) AND table_name = %s AND column_name = %s",
+		r.Placeholders.placeholder(DollarPlaceholders, 1), r.Placeholders.placeholder(DollarPlaceholders, 2), r.Placeholders.placeholder(DollarPlaceholders, 3)), schema, name, column)
+}
+
+func (r RedshiftDialect) DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", table))
+}
+
+func (r RedshiftDialect) VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, CAST(EXTRACT(EPOCH FROM tstamp) AS BIGINT), duration_ms FROM %s ORDER BY id", table))
+}
+
+func (r RedshiftDialect) ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY id", table))
+}
+
+func (r RedshiftDialect) VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT is_applied, metadata FROM %s WHERE version_id = %s ORDER BY id DESC", table, r.Placeholders.placeholder(DollarPlaceholders, 1)), version)
+}
+
+// redshift has no advisory locks
+func (r RedshiftDialect) LockSql(table string) string {
+	return ""
 }
 
-func (m Sqlite3Dialect) insertVersionSql() string {
-	return "INSERT INTO goose_db_version (version_id, is_applied) VALUES (?, ?);"
+func (r RedshiftDialect) UnlockSql(table string) string {
+	return ""
 }
 
-func (m Sqlite3Dialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query("SELECT version_id, is_applied from goose_db_version ORDER BY id DESC")
+func (r RedshiftDialect) AddColumnSql(table, name, sqlType string) string {
+	if sqlType == "TEXT" {
+		sqlType = "VARCHAR(65535)"
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s NULL;", table, name, sqlType)
+}
+
+func (r RedshiftDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+////////////////////////////
+// SQL Server
+////////////////////////////
+
+type SqlServerDialect struct {
+	// placeholder style of the driver, AtPlaceholders if it's not set
+	Placeholders PlaceholderStyle
+}
+
+func (m SqlServerDialect) CreateVersionTableSql(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id INT NOT NULL IDENTITY(1,1),
+                version_id BIGINT NOT NULL,
+                is_applied BIT NOT NULL,
+                tstamp DATETIME2 NULL DEFAULT %s,
+                checksum VARCHAR(64) NULL,
+                duration_ms BIGINT NULL,
+                metadata NVARCHAR(MAX) NULL,
+                PRIMARY KEY(id)
+            );`, table, m.NowSql())
+}
+
+// go-mssqldb uses named ordinal placeholders
+func (m SqlServerDialect) InsertVersionSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, tstamp) VALUES (%s, %s);", table, m.Placeholders.placeholders(AtPlaceholders, 4), m.NowSql())
+}
 
-	return rows, err
+func (m SqlServerDialect) InsertVersionMetadataSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, metadata, tstamp) VALUES (%s, %s);", table, m.Placeholders.placeholders(AtPlaceholders, 5), m.NowSql())
+}
+
+func (m SqlServerDialect) DeleteVersionSql(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = %s;", table, m.Placeholders.placeholder(AtPlaceholders, 1))
+}
+
+// the server's clock may not be in UTC
+func (m SqlServerDialect) NowSql() string {
+	return "SYSUTCDATETIME()"
+}
+
+func (m SqlServerDialect) TableExists(db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(table)
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = COALESCE(NULLIF(%s, ''), SCHEMA_NAME()) AND TABLE_NAME = %s",
+		m.Placeholders.placeholder(AtPlaceholders, 1), m.Placeholders.placeholder(AtPlaceholders, 2)), schema, name)
+}
+
+func (m SqlServerDialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	schema, name := splitTableName(table)
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = COALESCE(NULLIF(%s, ''), SCHEMA_NAME()) AND TABLE_NAME = %s AND COLUMN_NAME = %s",
+		m.Placeholders.placeholder(AtPlaceholders, 1), m.Placeholders.placeholder(AtPlaceholders, 2), m.Placeholders.placeholder(AtPlaceholders, 3)), schema, name, column)
+}
+
+func (m SqlServerDialect) DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied FROM %s ORDER BY id DESC", table))
+}
+
+func (m SqlServerDialect) VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, DATEDIFF_BIG(SECOND, '1970-01-01', tstamp), duration_ms FROM %s ORDER BY id", table))
+}
+
+func (m SqlServerDialect) ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY id", table))
+}
+
+func (m SqlServerDialect) VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT is_applied, metadata FROM %s WHERE version_id = %s ORDER BY id DESC", table, m.Placeholders.placeholder(AtPlaceholders, 1)), version)
+}
+
+func (m SqlServerDialect) LockSql(table string) string {
+	return fmt.Sprintf("EXEC sp_getapplock @Resource = '%s', @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = -1;", table)
+}
+
+func (m SqlServerDialect) UnlockSql(table string) string {
+	return fmt.Sprintf("EXEC sp_releaseapplock @Resource = '%s', @LockOwner = 'Session';", table)
+}
+
+// TEXT is deprecated, in favour of NVARCHAR(MAX)
+func (m SqlServerDialect) AddColumnSql(table, name, sqlType string) string {
+	if sqlType == "TEXT" {
+		sqlType = "NVARCHAR(MAX)"
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD %s %s NULL;", table, name, sqlType)
+}
+
+func (m SqlServerDialect) QuoteIdentifier(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// error 1205, a transaction chosen as a deadlock victim
+func (m SqlServerDialect) IsRetryable(err error) bool {
+	return strings.Contains(err.Error(), "deadlock victim")
+}
+
+func (m SqlServerDialect) SavepointSql(name string) string {
+	return fmt.Sprintf("SAVE TRANSACTION %s;", name)
+}
+
+func (m SqlServerDialect) RollbackToSavepointSql(name string) string {
+	return fmt.Sprintf("ROLLBACK TRANSACTION %s;", name)
+}
+
+////////////////////////////
+// ClickHouse
+////////////////////////////
+
+// ClickHouse has neither transactions nor auto-increment, so the
+// version table's id is the time each row was inserted, which still
+// orders the rows as goose expects, and its migrations are run as if
+// annotated NO TRANSACTION.
+type ClickHouseDialect struct {
+	// placeholder style of the driver, QuestionPlaceholders if it's not set
+	Placeholders PlaceholderStyle
+}
+
+func (m ClickHouseDialect) CreateVersionTableSql(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id UInt64 DEFAULT toUnixTimestamp64Nano(now64(9)),
+                version_id Int64,
+                is_applied UInt8,
+                tstamp DateTime DEFAULT %s,
+                checksum Nullable(String),
+                duration_ms Nullable(Int64),
+                metadata Nullable(String)
+            ) ENGINE = MergeTree() ORDER BY (version_id, id)`, table, m.NowSql())
+}
+
+func (m ClickHouseDialect) InsertVersionSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, tstamp) VALUES (%s, %s)", table, m.Placeholders.placeholders(QuestionPlaceholders, 4), m.NowSql())
+}
+
+func (m ClickHouseDialect) InsertVersionMetadataSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, metadata, tstamp) VALUES (%s, %s)", table, m.Placeholders.placeholders(QuestionPlaceholders, 5), m.NowSql())
+}
+
+// rows are deleted by a mutation, which is applied asynchronously
+func (m ClickHouseDialect) DeleteVersionSql(table string) string {
+	return fmt.Sprintf("ALTER TABLE %s DELETE WHERE version_id = %s", table, m.Placeholders.placeholder(QuestionPlaceholders, 1))
+}
+
+// DateTime columns hold a unix timestamp
+func (m ClickHouseDialect) NowSql() string {
+	return "now()"
+}
+
+// a schema in clickhouse is a database
+func (m ClickHouseDialect) TableExists(db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(table)
+	return queryTableExists(db, fmt.Sprintf("SELECT count() FROM system.tables WHERE database = if(%s = '', currentDatabase(), %s) AND name = %s",
+		m.Placeholders.placeholder(QuestionPlaceholders, 1), m.Placeholders.placeholder(QuestionPlaceholders, 2), m.Placeholders.placeholder(QuestionPlaceholders, 3)),
+		schema, schema, name)
+}
+
+func (m ClickHouseDialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	schema, name := splitTableName(table)
+	return queryTableExists(db, fmt.Sprintf("SELECT count() FROM system.columns WHERE database = if(%s = '', currentDatabase(), %s) AND table = %s AND name = %s",
+		m.Placeholders.placeholder(QuestionPlaceholders, 1), m.Placeholders.placeholder(QuestionPlaceholders, 2), m.Placeholders.placeholder(QuestionPlaceholders, 3), m.Placeholders.placeholder(QuestionPlaceholders, 4)),
+		schema, schema, name, column)
+}
+
+func (m ClickHouseDialect) DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied FROM %s ORDER BY id DESC", table))
+}
+
+func (m ClickHouseDialect) VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, toInt64(toUnixTimestamp(tstamp)), duration_ms FROM %s ORDER BY id", table))
+}
+
+func (m ClickHouseDialect) ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, is_applied, checksum FROM %s ORDER BY id", table))
+}
+
+func (m ClickHouseDialect) VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT is_applied, metadata FROM %s WHERE version_id = %s ORDER BY id DESC", table, m.Placeholders.placeholder(QuestionPlaceholders, 1)), version)
+}
+
+// clickhouse has no session locks
+func (m ClickHouseDialect) LockSql(table string) string {
+	return ""
+}
+
+func (m ClickHouseDialect) UnlockSql(table string) string {
+	return ""
+}
+
+func (m ClickHouseDialect) AddColumnSql(table, name, sqlType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s Nullable(%s)", table, name, sqlType)
+}
+
+func (m ClickHouseDialect) QuoteIdentifier(name string) string {
+	return "`" + strings.NewReplacer(`\`, `\\`, "`", "\\`").Replace(name) + "`"
+}
+
+func (m ClickHouseDialect) NoTransactions() bool {
+	return true
+}
+
+////////////////////////////
+// Oracle
+////////////////////////////
+
+// Oracle has no boolean type, so is_applied is a NUMBER(1), and its
+// drivers reject the semicolon that ends a statement, so goose's own
+// SQL has none, and those of SQL migrations are trimmed.
+type OracleDialect struct {
+	// placeholder style of the driver, ColonPlaceholders if it's not set
+	Placeholders PlaceholderStyle
+}
+
+func (o OracleDialect) CreateVersionTableSql(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+                id NUMBER(19) GENERATED BY DEFAULT AS IDENTITY,
+                version_id NUMBER(19) NOT NULL,
+                is_applied NUMBER(1) NOT NULL,
+                tstamp TIMESTAMP DEFAULT %s,
+                checksum VARCHAR2(64) NULL,
+                duration_ms NUMBER(19) NULL,
+                metadata VARCHAR2(4000) NULL,
+                PRIMARY KEY(id)
+            )`, table, o.NowSql())
+}
+
+func (o OracleDialect) InsertVersionSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, tstamp) VALUES (%s, %s)", table, o.Placeholders.placeholders(ColonPlaceholders, 4), o.NowSql())
+}
+
+func (o OracleDialect) InsertVersionMetadataSql(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, duration_ms, metadata, tstamp) VALUES (%s, %s)", table, o.Placeholders.placeholders(ColonPlaceholders, 5), o.NowSql())
+}
+
+func (o OracleDialect) DeleteVersionSql(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id = %s", table, o.Placeholders.placeholder(ColonPlaceholders, 1))
+}
+
+// SYSTIMESTAMP is in the server's time zone
+func (o OracleDialect) NowSql() string {
+	return "SYS_EXTRACT_UTC(SYSTIMESTAMP)"
+}
+
+// oracle treats an empty string as NULL, so an unqualified table is
+// looked up in the current schema via NVL
+func (o OracleDialect) TableExists(db *sql.DB, table string) (bool, error) {
+	schema, name := splitTableName(strings.ToUpper(table))
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM all_tables WHERE owner = NVL(%s, SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA')) AND table_name = %s",
+		o.Placeholders.placeholder(ColonPlaceholders, 1), o.Placeholders.placeholder(ColonPlaceholders, 2)), schema, name)
+}
+
+func (o OracleDialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	schema, name := splitTableName(strings.ToUpper(table))
+	column = strings.ToUpper(column)
+	return queryTableExists(db, fmt.Sprintf("SELECT COUNT(*) FROM all_tab_columns WHERE owner = NVL(%s, SYS_CONTEXT('USERENV', 'CURRENT_SCHEMA')) AND table_name = %s AND column_name = %s",
+		o.Placeholders.placeholder(ColonPlaceholders, 1), o.Placeholders.placeholder(ColonPlaceholders, 2), o.Placeholders.placeholder(ColonPlaceholders, 3)), schema, name, column)
+}
+
+// is_applied is read as text that database/sql can scan into a bool,
+// whatever type the driver would otherwise give a NUMBER
+func (o OracleDialect) DbVersionQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, CASE WHEN is_applied = 1 THEN 'true' ELSE 'false' END FROM %s ORDER BY id DESC", table))
+}
+
+func (o OracleDialect) VersionHistoryQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, CASE WHEN is_applied = 1 THEN 'true' ELSE 'false' END, "+
+		"ROUND((CAST(tstamp AS DATE) - DATE '1970-01-01') * 86400), duration_ms FROM %s ORDER BY id", table))
+}
+
+func (o OracleDialect) ChecksumQuery(db *sql.DB, table string) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT version_id, CASE WHEN is_applied = 1 THEN 'true' ELSE 'false' END, checksum FROM %s ORDER BY id", table))
+}
+
+func (o OracleDialect) VersionMetadataQuery(db *sql.DB, table string, version int64) (*sql.Rows, error) {
+	return db.Query(fmt.Sprintf("SELECT CASE WHEN is_applied = 1 THEN 'true' ELSE 'false' END, metadata FROM %s WHERE version_id = %s ORDER BY id DESC", table, o.Placeholders.placeholder(ColonPlaceholders, 1)), version)
+}
+
+// oracle's locks need DBMS_LOCK, which few users may execute
+func (o OracleDialect) LockSql(table string) string {
+	return ""
+}
+
+func (o OracleDialect) UnlockSql(table string) string {
+	return ""
+}
+
+func (o OracleDialect) AddColumnSql(table, name, sqlType string) string {
+	switch sqlType {
+	case "BIGINT":
+		sqlType = "NUMBER(19)"
+	case "TEXT":
+		sqlType = "VARCHAR2(4000)"
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD %s %s NULL", table, name, sqlType)
+}
+
+// oracle folds unquoted names to upper case, so names are folded
+// likewise, and the version table can be queried without quotes
+func (o OracleDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(strings.ToUpper(name), `"`, `""`) + `"`
+}
+
+// oracle commits before and after each DDL statement,
+// whether or not a transaction is open
+func (o OracleDialect) CommitsDDL() bool {
+	return true
+}
+
+func (o OracleDialect) EncodeBool(b bool) interface{} {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// deadlocks (ORA-00060) and serialization failures (ORA-08177)
+func (o OracleDialect) IsRetryable(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "ORA-00060") || strings.Contains(msg, "ORA-08177")
+}
+
+// the trailing semicolon of a statement is dropped, except from PL/SQL
+// blocks, e.g. CREATE PROCEDURE ... END;, of which it's a part
+func (o OracleDialect) TrimStatement(stmt string) string {
+	trimmed := strings.TrimRightFunc(stmt, unicode.IsSpace)
+	if !strings.HasSuffix(trimmed, ";") || isPLSQLBlock(trimmed) {
+		return stmt
+	}
+	return strings.TrimSuffix(trimmed, ";") + "\n"
+}
+
+// does the statement begin a PL/SQL block, or create a stored unit?
+func isPLSQLBlock(stmt string) bool {
+	words := strings.Fields(strings.ToUpper(statementPrefix(stmt, 80)))
+	if len(words) == 0 {
+		return false
+	}
+
+	switch words[0] {
+	case "BEGIN", "DECLARE":
+		return true
+	case "CREATE":
+		for _, w := range words[1:] {
+			switch w {
+			case "FUNCTION", "PROCEDURE", "PACKAGE", "TRIGGER", "TYPE":
+				return true
+			case "TABLE", "INDEX", "VIEW", "SEQUENCE", "SYNONYM":
+				return false
+			}
+		}
+	}
+	return false
 }
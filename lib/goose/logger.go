@@ -0,0 +1,58 @@
+package goose
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logger is what goose reports its progress, and any warnings,
+// through. A *log.Logger will do.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// by default, progress is printed to stdout as it always has been
+var logger Logger = log.New(os.Stdout, "", 0)
+
+// SetLogger routes goose's progress and warnings through l,
+// rather than printing them to stdout.
+func SetLogger(l Logger) {
+	logger = l
+}
+
+// whether the in-process API logs verbosely. see DBConf.Verbose.
+var verbose bool
+
+// SetVerbose sets whether the in-process API logs each SQL
+// statement as it's run, and how long each migration took.
+func SetVerbose(v bool) {
+	verbose = v
+}
+
+// log a statement of the migration for version, if conf asks for it
+func logStatement(conf *DBConf, version int64, direction bool, stmt string) {
+	if !conf.Verbose {
+		return
+	}
+
+	directionStr := "rolling back"
+	if direction {
+		directionStr = "applying"
+	}
+	logger.Printf("goose: %s version %d: %s\n", directionStr, version, strings.TrimSpace(stmt))
+}
+
+// log that the migration m has been run, in elapsed if conf asks for it
+func logMigrated(conf *DBConf, m *Migration, elapsed time.Duration) {
+	if conf.DryRun {
+		return
+	}
+
+	if conf.Verbose {
+		logger.Printf("OK    %s (%v)\n", m.name(), elapsed.Round(time.Millisecond))
+		return
+	}
+	logger.Printf("OK    %s\n", m.name())
+}
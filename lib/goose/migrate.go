@@ -1,12 +1,23 @@
 package goose
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"go/token"
+	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,19 +30,69 @@ import (
 var (
 	ErrTableDoesNotExist = errors.New("table does not exist")
 	ErrNoPreviousVersion = errors.New("no previous version found")
+
+	// there's nothing to redo or roll back
+	ErrNoCurrentVersion = errors.New("no migrations have been applied")
+	// a migration to be rolled back has no Down section or function
+	ErrMissingDownMigration = errors.New("no Down migration")
+	// more than one migration has the same version
+	ErrDuplicateVersion = errors.New("duplicate version")
+	// DBConf.NoVersioning is set, so the version table can't be used
+	ErrNoVersioning = errors.New("only up can be run without versioning")
 )
 
+// MigrationError is the error of a migration that failed to be
+// applied, if Direction is true, or rolled back. It wraps the
+// error that it failed with, such as that of the driver.
+type MigrationError struct {
+	Version   int64
+	Direction bool
+	Source    string
+	Err       error
+}
+
+func (e *MigrationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
 type MigrationRecord struct {
+	Id        int64 // of the version table row, or 0 if unknown
 	VersionId int64
 	TStamp    time.Time
-	IsApplied bool // was this a result of up() or down()
+	IsApplied bool            // was this a result of up() or down()
+	Checksum  string          // hex SHA-256 of the migration's source, or "" if unknown
+	Duration  time.Duration   // how long the migration took to run, or 0 if unknown
+	Metadata  json.RawMessage // JSON kept by a registered Go migration for its Down, or nil
 }
 
 type Migration struct {
-	Version  int64
-	Next     int64  // next version, or -1 if none
-	Previous int64  // previous version, -1 if none
-	Source   string // path to .go or .sql script
+	Version    int64
+	Next       int64  // next version, or -1 if none
+	Previous   int64  // previous version, -1 if none
+	Source     string // path to .go or .sql script
+	Registered bool   // Go migration registered via AddMigration
+	UpFn       func(*sql.Tx) error
+	DownFn     func(*sql.Tx) error
+
+	// set instead of UpFn and DownFn via AddMigrationWithMetadata
+	UpMetadataFn   func(*sql.Tx) (json.RawMessage, error)
+	DownMetadataFn func(*sql.Tx, json.RawMessage) error
+
+	section []byte // for one of several migrations in a combined Source file, its part of it
+	body    []byte // for a migration given as a MigrationSource, its source
+}
+
+// the name of the migration used in output, that of its file,
+// qualified by its version if it's from a combined file
+func (m *Migration) name() string {
+	if m.section != nil {
+		return fmt.Sprintf("%s#%d", filepath.Base(m.Source), m.Version)
+	}
+	return filepath.Base(m.Source)
 }
 
 type migrationSorter []*Migration
@@ -42,7 +103,7 @@ func (ms migrationSorter) Swap(i, j int)      { ms[i], ms[j] = ms[j], ms[i] }
 func (ms migrationSorter) Less(i, j int) bool { return ms[i].Version < ms[j].Version }
 
 func newMigration(v int64, src string) *Migration {
-	return &Migration{v, -1, -1, src}
+	return &Migration{Version: v, Next: -1, Previous: -1, Source: src}
 }
 
 func RunMigrations(conf *DBConf, migrationsDir string, target int64, direction string) (err error) {
@@ -58,284 +119,2473 @@ func RunMigrations(conf *DBConf, migrationsDir string, target int64, direction s
 
 // Runs migration on a specific database instance.
 func RunMigrationsOnDb(conf *DBConf, migrationsDir string, target int64, db *sql.DB, direction string) (err error) {
+
+	if conf.NoVersioning && direction != "up" {
+		return ErrNoVersioning
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	return runMigrations(conf, migrationsDir, target, db, direction)
+}
+
+// RunMigrationsOnDb, for callers that already hold the lock
+func runMigrations(conf *DBConf, migrationsDir string, target int64, db *sql.DB, direction string) (err error) {
+
+	if conf.NoVersioning {
+		return runUnversioned(conf, migrationsDir, target, db, direction)
+	}
+
 	current, err := EnsureDBVersion(conf, db)
 	if err != nil {
 		return err
 	}
 
-	migrations, err := GetMigrationsFromDisk(migrationsDir, target)
+	migrations, err := collectMigrations(conf, append([]string{migrationsDir}, conf.MigrationsDirs...)...)
 	if err != nil {
 		return err
 	}
-	applied, err := GetAppliedMigrations(conf, db)
+
+	return migrateTo(conf, db, current, migrations, target, direction)
+}
+
+// run the Up statements of every SQL migration up to target,
+// whether or not it's been applied, leaving the version table alone
+func runUnversioned(conf *DBConf, migrationsDir string, target int64, db *sql.DB, direction string) error {
+
+	if direction != "up" {
+		return ErrNoVersioning
+	}
+	if conf.Fake {
+		return errors.New("faking migrations records them, so needs versioning")
+	}
+
+	migrations, err := collectMigrations(conf, append([]string{migrationsDir}, conf.MigrationsDirs...)...)
 	if err != nil {
 		return err
 	}
+	sort.Sort(migrationSorter(migrations))
 
-	todo := migrationSorter(migrations).Todo(target, applied, direction)
-
-	if len(todo) == 0 {
-		fmt.Printf("goose: no migrations to run. current version: %d\n", current)
-		return nil
+	var todo []*Migration
+	for _, m := range migrations {
+		if m.Version > target {
+			continue
+		}
+		if migrationExt(m.Source) != ".sql" {
+			return fmt.Errorf("%s: Go migrations can't be run without versioning", m.name())
+		}
+		if err = validateMigration(conf, m, true); err != nil {
+			return err
+		}
+		todo = append(todo, m)
 	}
 
-	fmt.Printf("goose: migrating db environment '%v', current version: %d, target: %d\n",
-		conf.Env, current, target)
+	logger.Printf("goose: running db environment '%v' without versioning, target: %d%s\n", conf.Env, target, runMode(conf))
 
 	for _, m := range todo {
-
-		switch filepath.Ext(m.Source) {
-		case ".go":
-			err = runGoMigration(conf, m.Source, m.Version, direction == "up")
-		case ".sql":
-			err = runSQLMigration(conf, db, m.Source, m.Version, direction == "up")
+		start := time.Now()
+		if err = runUnversionedSQL(conf, db, m); err != nil {
+			return fmt.Errorf("FAIL %s: %w, quitting", m.name(), err)
 		}
+		logMigrated(conf, m, time.Since(start))
+	}
+
+	return nil
+}
+
+// everything other than up reads or writes the version table,
+// so fails when DBConf.NoVersioning is set
+func checkVersioning(conf *DBConf) error {
+	if conf.NoVersioning {
+		return ErrNoVersioning
+	}
+	return nil
+}
+
+// MigrationSource is a migration that isn't read from a file,
+// e.g. one fetched over the network, for RunMigrationSourcesOnDb.
+type MigrationSource struct {
+	Version int64     // or 0 to take it from Name, as from a filename
+	Name    string    // e.g. 20130106093224_add_user.sql, as used in output
+	Body    io.Reader // the SQL of the migration, with its annotations
+	IsGo    bool      // a Go migration, which must be registered via AddMigration
+}
+
+// RunMigrationSourcesOnDb runs the given migrations, just as
+// RunMigrationsOnDb runs those it finds on disk, but without reading
+// any files at all. Go migrations can only be run this way if they're
+// registered via AddMigration, when they're run from their
+// registration, and their Body is ignored.
+func RunMigrationSourcesOnDb(conf *DBConf, db *sql.DB, sources []MigrationSource, target int64, direction string) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	migrations, err := sourceMigrations(conf, sources)
+	if err != nil {
+		return err
+	}
 
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
 		if err != nil {
-			return errors.New(fmt.Sprintf("FAIL %v, quitting migration", err))
+			return err
 		}
+		defer unlock()
+	}
 
-		fmt.Println("OK   ", filepath.Base(m.Source))
+	current, err := EnsureDBVersion(conf, db)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return migrateTo(conf, db, current, migrations, target, direction)
 }
 
-// collect all the valid looking migration scripts in the
-// migrations folder, and key them by version
-func GetMigrationsFromDisk(dirpath string, target int64) (m []*Migration, err error) {
+// the migrations given by sources, read in full
+func sourceMigrations(conf *DBConf, sources []MigrationSource) ([]*Migration, error) {
 
-	// extract the numeric component of each migration,
-	// filter out any uninteresting files,
-	// and ensure we only have one file per migration version.
-	filepath.Walk(dirpath, func(name string, info os.FileInfo, err error) error {
+	var migrations []*Migration
+	seen := make(map[int64]string)
 
-		if v, e := NumericComponent(name); e == nil {
+	for _, s := range sources {
+		v := s.Version
+		if v == 0 {
+			n, err := NumericComponent(s.Name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", s.Name, err)
+			}
+			v = n
+		}
 
-			for _, g := range m {
-				if v == g.Version {
-					log.Fatalf("more than one file specifies the migration for version %d (%s and %s)",
-						v, g.Source, filepath.Join(dirpath, name))
-				}
+		if name, ok := seen[v]; ok {
+			if !conf.AllowDuplicateVersions {
+				return nil, fmt.Errorf("%w: more than one source specifies the migration for version %d (%s and %s)",
+					ErrDuplicateVersion, v, name, s.Name)
 			}
+			logger.Printf("WARNING: more than one source specifies the migration for version %d, ignoring %s\n", v, s.Name)
+			continue
+		}
+		seen[v] = s.Name
 
-			m = append(m, newMigration(v, name))
+		if s.IsGo {
+			rm, ok := registeredGoMigrations[v]
+			if !ok {
+				return nil, fmt.Errorf("%s: Go migrations given as sources must be registered via goose.AddMigration", s.Name)
+			}
+			migrations = append(migrations, rm)
+			continue
 		}
 
-		return nil
-	})
+		if !strings.HasSuffix(s.Name, ".sql") {
+			return nil, fmt.Errorf("%s: a SQL migration's name must end in .sql", s.Name)
+		}
+		if s.Body == nil {
+			return nil, fmt.Errorf("%s: no body", s.Name)
+		}
+		body, err := ioutil.ReadAll(s.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.Name, err)
+		}
 
-	return m, nil
+		m := newMigration(v, s.Name)
+		m.body = body
+		migrations = append(migrations, m)
+	}
+
+	return migrations, nil
 }
 
-func (ms migrationSorter) Sort(direction string) {
+// migrate from the current version to target, given the migrations
+// there are, checking them all before running any
+func migrateTo(conf *DBConf, db *sql.DB, current int64, migrations []*Migration, target int64, direction string) (err error) {
 
-	// sort ascending or descending by version
-	if direction == "up" {
-		sort.Sort(ms)
-	} else {
-		sort.Sort(sort.Reverse(ms))
+	applied, err := GetAppliedMigrations(conf, db)
+	if err != nil {
+		return err
 	}
 
-	// now that we're sorted in the appropriate direction,
-	// populate next and previous for each migration
-	for i, m := range ms {
-		prev := int64(-1)
-		if i > 0 {
-			prev = ms[i-1].Version
-			ms[i-1].Next = m.Version
+	if !conf.IgnoreChecksums {
+		if err = verifyChecksums(conf, db, migrations); err != nil {
+			return err
 		}
-		ms[i].Previous = prev
 	}
-}
-
-func (ms migrationSorter) Todo(target int64, applied map[int64]bool, direction string) []*Migration {
-
-	ms.Sort(direction)
 
-	migrations := []*Migration{}
+	// skipped migrations mustn't count as missing either
+	if conf.SkipGo {
+		migrations = skipGoMigrations(migrations, target, applied, direction)
+	}
 
-	for _, m := range ms {
-		if shouldApplyMigration(m, target, applied, direction) {
-			migrations = append(migrations, m)
+	if direction == "up" {
+		if missing := missingMigrations(migrations, applied); len(missing) > 0 {
+			if !conf.AllowMissing {
+				return fmt.Errorf("found %d out-of-order migration(s) older than the current version: %v",
+					len(missing), missing)
+			}
+			logger.Printf("WARNING: applying out-of-order migration(s) older than the current version: %v\n", missing)
 		}
 	}
 
-	return migrations
-}
+	todo := migrationSorter(migrations).Todo(target, applied, direction)
 
-func shouldApplyMigration(m *Migration, target int64, applied map[int64]bool, direction string) bool {
-	if direction == "down" {
-		return m.Version > target && applied[m.Version]
-	} else if direction == "up" {
-		return m.Version <= target && !applied[m.Version]
+	// check every migration before running any, rather
+	// than leaving the db part way to its target
+	for _, m := range todo {
+		if err = validateMigration(conf, m, direction == "up"); err != nil {
+			return err
+		}
+	}
+	if err = checkGoCommand(conf, todo); err != nil {
+		return err
 	}
 
-	panic("Invalid direction: " + direction)
-}
+	if len(todo) == 0 {
+		logger.Printf("goose: no migrations to run. current version: %d\n", current)
+		return nil
+	}
 
-// look for migration scripts with names in the form:
-//  XXX_descriptivename.ext
-// where XXX specifies the version number
-// and ext specifies the type of migration
-func NumericComponent(name string) (int64, error) {
+	var batch []*batchMigration
+	if conf.Batch && !conf.DryRun && !conf.Fake {
+		if batch, err = prepareBatch(conf, todo, direction == "up"); err != nil {
+			return err
+		}
+	}
 
-	base := filepath.Base(name)
+	logger.Printf("goose: migrating db environment '%v', current version: %d, target: %d%s\n",
+		conf.Env, current, target, runMode(conf))
 
-	if ext := filepath.Ext(base); ext != ".go" && ext != ".sql" {
-		return 0, errors.New("not a recognized migration file type")
+	if batch != nil {
+		return runBatch(conf, db, batch, direction == "up")
 	}
 
-	idx := strings.Index(base, "_")
-	if idx < 0 {
-		return 0, errors.New("no separator found")
-	}
+	for _, m := range todo {
 
-	n, e := strconv.ParseInt(base[:idx], 10, 64)
-	if e == nil && n <= 0 {
-		return 0, errors.New("migration IDs must be greater than zero")
+		start := time.Now()
+		if err = runMigration(conf, db, m, direction == "up"); err != nil {
+			return fmt.Errorf("FAIL %w, quitting migration", err)
+		}
+
+		logMigrated(conf, m, time.Since(start))
 	}
 
-	return n, e
+	return nil
 }
 
-func GetAppliedMigrations(conf *DBConf, db *sql.DB) (map[int64]bool, error) {
-	versions := make(map[int64]bool)
+// read and split every migration of a batch, for DBConf.Batch,
+// before any is run
+func prepareBatch(conf *DBConf, todo []*Migration, direction bool) ([]*batchMigration, error) {
 
-	rows, err := db.Query("SELECT version_id, is_applied FROM goose_db_version ORDER BY tstamp")
-	if err != nil {
-		if err == ErrTableDoesNotExist {
-			return versions, createVersionTable(conf, db)
-		}
-		return versions, err
+	if _, ok := conf.Driver.Dialect.(savepointer); !ok {
+		return nil, fmt.Errorf("the %s dialect has no savepoints, so it can't run migrations in a batch",
+			dialectName(conf.Driver.Dialect))
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var row MigrationRecord
-		if err = rows.Scan(&row.VersionId, &row.IsApplied); err != nil {
-			log.Fatal("error scanning rows:", err)
+	batch := make([]*batchMigration, 0, len(todo))
+	for _, m := range todo {
+		bm, err := prepareBatchSQL(conf, m, direction)
+		if err != nil {
+			return nil, err
 		}
-
-		versions[row.VersionId] = row.IsApplied
+		batch = append(batch, bm)
 	}
-
-	return versions, nil
+	return batch, nil
 }
 
-// retrieve the current version for this DB.
-// Create and initialize the DB version table if it doesn't exist.
-func EnsureDBVersion(conf *DBConf, db *sql.DB) (int64, error) {
+// run a batch of migrations in one transaction, each within a savepoint
+// of its own. a migration that fails is rolled back to its savepoint,
+// and the ones before it are committed, as if they'd been run alone.
+func runBatch(conf *DBConf, db *sql.DB, batch []*batchMigration, direction bool) error {
+
+	sp := conf.Driver.Dialect.(savepointer)
 
-	rows, err := conf.Driver.Dialect.dbVersionQuery(db)
+	txn, err := db.Begin()
 	if err != nil {
-		if err == ErrTableDoesNotExist {
-			return 0, createVersionTable(conf, db)
-		}
-		return 0, err
+		return fmt.Errorf("db.Begin: %w", err)
 	}
-	defer rows.Close()
 
-	// The most recent record for each migration specifies
-	// whether it has been applied or rolled back.
-	// The first version we find that has been applied is the current version.
-
-	toSkip := make([]int64, 0)
+	for _, bm := range batch {
 
-	for rows.Next() {
-		var row MigrationRecord
-		if err = rows.Scan(&row.VersionId, &row.IsApplied); err != nil {
-			log.Fatal("error scanning rows:", err)
+		savepoint := fmt.Sprintf("goose_%d", bm.m.Version)
+		if _, err = txn.Exec(sp.SavepointSql(savepoint)); err != nil {
+			txn.Rollback()
+			return fmt.Errorf("FAIL %s: savepoint: %w, quitting migration", bm.m.name(), err)
 		}
 
-		// have we already marked this version to be skipped?
-		skip := false
-		for _, v := range toSkip {
-			if v == row.VersionId {
-				skip = true
-				break
+		start := time.Now()
+		if err = runBatchMigration(conf, txn, bm, direction); err != nil {
+			if _, rerr := txn.Exec(sp.RollbackToSavepointSql(savepoint)); rerr != nil {
+				txn.Rollback()
+				return fmt.Errorf("FAIL %w, and rolling back to its savepoint failed, so the whole batch was rolled back: %v",
+					err, rerr)
 			}
+			if cerr := txn.Commit(); cerr != nil {
+				return fmt.Errorf("FAIL %w, and committing the migrations before it failed: %v", err, cerr)
+			}
+			return fmt.Errorf("FAIL %w, quitting migration", err)
 		}
 
-		if skip {
-			continue
-		}
+		logMigrated(conf, bm.m, time.Since(start))
+	}
 
-		// if version has been applied we're done
-		if row.IsApplied {
-			return row.VersionId, nil
-		}
+	return txn.Commit()
+}
 
-		// latest version of migration has not been applied.
-		toSkip = append(toSkip, row.VersionId)
+// run one migration of a batch, as runMigration does one alone.
+// any error is a *MigrationError.
+func runBatchMigration(conf *DBConf, txn *sql.Tx, bm *batchMigration, direction bool) (err error) {
+
+	m := bm.m
+	if conf.Observer != nil {
+		start := time.Now()
+		observe(func() { conf.Observer.OnMigrationStart(m.Version, direction) })
+		defer func() {
+			if err != nil {
+				observe(func() { conf.Observer.OnMigrationError(m.Version, direction, err) })
+				return
+			}
+			observe(func() { conf.Observer.OnMigrationComplete(m.Version, direction, time.Since(start)) })
+		}()
 	}
 
-	panic("failure in EnsureDBVersion()")
+	defer func() {
+		if err != nil {
+			err = &MigrationError{Version: m.Version, Direction: direction, Source: m.Source, Err: err}
+		}
+	}()
+
+	return runBatchSQL(conf, txn, bm, direction)
 }
 
-// Create the goose_db_version table
-// and insert the initial 0 value into it
-func createVersionTable(conf *DBConf, db *sql.DB) error {
-	txn, err := db.Begin()
-	if err != nil {
-		return err
+// call one of an Observer's methods, which mustn't stop the migration
+func observe(call func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Printf("WARNING: migration observer panicked: %v\n", r)
+		}
+	}()
+	call()
+}
+
+// how migrations are being run, if not for real, for the log
+func runMode(conf *DBConf) string {
+	mode := ""
+	if conf.Fake {
+		mode += " (fake)"
+	}
+	if conf.DryRun {
+		mode += " (dry run)"
 	}
+	return mode
+}
 
-	d := conf.Driver.Dialect
+// record a migration as applied, or rolled back, without running it,
+// e.g. when the schema has been restored from a snapshot that already
+// includes it. only the version table is touched, so Go migrations
+// are faked just like SQL ones.
+func fakeMigration(conf *DBConf, db *sql.DB, m *Migration, direction bool) error {
 
-	if _, err := txn.Exec(d.createVersionTableSql()); err != nil {
-		txn.Rollback()
-		return err
+	if conf.DryRun {
+		state := "rolled back"
+		if direction {
+			state = "applied"
+		}
+		fmt.Printf("\n-- goose dry run: would record %s as %s, without running it\n", m.name(), state)
+		return nil
 	}
 
-	version := 0
-	applied := true
-	if _, err := txn.Exec(d.insertVersionSql(), version, applied); err != nil {
-		txn.Rollback()
+	// the source of a migration compiled into another
+	// binary may not be around to checksum
+	checksum := ""
+	src, err := readMigration(conf, m)
+	switch {
+	case err == nil:
+		checksum = bytesChecksum(src)
+	case !(m.Registered && os.IsNotExist(err)):
 		return err
 	}
 
-	return txn.Commit()
-}
+	txn, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
 
-// wrapper for EnsureDBVersion for callers that don't already have
-// their own DB instance
-func GetDBVersion(conf *DBConf) (version int64, err error) {
+	return FinalizeMigrationRecord(conf, txn, MigrationRecord{VersionId: m.Version, IsApplied: direction, Checksum: checksum})
+}
 
-	db, err := OpenDBFromDBConf(conf)
-	if err != nil {
-		return -1, err
+// apply or roll back a single migration, according to its type.
+// any error is a *MigrationError.
+func runMigration(conf *DBConf, db *sql.DB, m *Migration, direction bool) (err error) {
+
+	if conf.Observer != nil && !conf.DryRun {
+		start := time.Now()
+		observe(func() { conf.Observer.OnMigrationStart(m.Version, direction) })
+		defer func() {
+			if err != nil {
+				observe(func() { conf.Observer.OnMigrationError(m.Version, direction, err) })
+				return
+			}
+			observe(func() { conf.Observer.OnMigrationComplete(m.Version, direction, time.Since(start)) })
+		}()
 	}
-	defer db.Close()
 
-	version, err = EnsureDBVersion(conf, db)
-	if err != nil {
-		return -1, err
+	defer func() {
+		if err != nil {
+			err = &MigrationError{Version: m.Version, Direction: direction, Source: m.Source, Err: err}
+		}
+	}()
+
+	if !direction {
+		irreversible, err := isIrreversible(conf, m)
+		if err != nil {
+			return err
+		}
+		if irreversible {
+			return fmt.Errorf("migration %d is irreversible", m.Version)
+		}
 	}
 
-	return version, nil
-}
+	if conf.Fake {
+		return fakeMigration(conf, db, m, direction)
+	}
 
-func GetPreviousDBVersion(dirpath string, version int64) (previous int64, err error) {
+	// a SQL migration whose ONLY IF condition doesn't hold is recorded,
+	// so that later versions still follow it, but its body is skipped
+	if migrationExt(m.Source) == ".sql" {
+		src, err := readMigration(conf, m)
+		if err != nil {
+			return err
+		}
+		holds, expr, err := sqlCondition(conf, src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name(), err)
+		}
+		if !holds {
+			logger.Printf("goose: skipping the body of %s, since ONLY IF %s doesn't hold\n", m.name(), expr)
+			return fakeMigration(conf, db, m, direction)
+		}
+	}
 
-	previous = -1
-	sawGivenVersion := false
+	if conf.DryRun {
+		return printMigration(conf, m, direction)
+	}
 
-	filepath.Walk(dirpath, func(name string, info os.FileInfo, walkerr error) error {
+	switch migrationExt(m.Source) {
+	case ".go":
+		if m.Registered {
+			return runRegisteredGoMigration(conf, db, m, direction)
+		}
 
-		if !info.IsDir() {
-			if v, e := NumericComponent(name); e == nil {
-				if v > previous && v < version {
-					previous = v
-				}
-				if v == version {
-					sawGivenVersion = true
-				}
+		if conf.GoPlugin != "" {
+			fn, err := pluginGoMigration(conf.GoPlugin, m.Version, direction)
+			switch {
+			case err == errPluginsUnsupported:
+				logger.Printf("WARNING: %v, running %s via `go run`\n", err, m.name())
+			case err != nil:
+				return err
+			case fn != nil:
+				pm := *m
+				pm.Registered = true
+				pm.UpFn, pm.DownFn = fn, fn
+				return runRegisteredGoMigration(conf, db, &pm, direction)
 			}
 		}
 
+		// `go run` needs to be able to open the DB for itself
+		if conf.Driver.OpenStr == "" && conf.OpenStrFunc == nil {
+			return fmt.Errorf("%s: Go migrations must be registered via goose.AddMigration to run in-process",
+				m.name())
+		}
+		return runGoMigration(conf, m.Source, m.Version, direction)
+
+	case ".sql":
+		return runSQLMigration(conf, db, m, direction)
+	}
+
+	return nil
+}
+
+// print what running the migration would do, for a dry run.
+// the SQL run by Go migrations isn't known ahead of time,
+// so only the function that would be run is printed.
+func printMigration(conf *DBConf, m *Migration, direction bool) error {
+
+	directionStr := "Down"
+	if direction {
+		directionStr = "Up"
+	}
+
+	src, err := readMigration(conf, m)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n-- goose dry run: %s %s\n", directionStr, m.name())
+
+	switch migrationExt(m.Source) {
+	case ".go":
+		fmt.Printf("-- would run %s_%d\n", directionStr, m.Version)
+
+	case ".sql":
+		r, err := sqlSource(conf, src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name(), err)
+		}
+
+		stmts, useTx, err := splitSQLStatements(r, direction)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name(), err)
+		}
+		if !runInTransaction(conf, useTx) {
+			fmt.Println("-- NO TRANSACTION")
+		}
+		if timeout, err := sqlTimeout(src); err != nil {
+			return fmt.Errorf("%s: %w", m.name(), err)
+		} else if timeout > 0 {
+			fmt.Printf("-- TIMEOUT %v\n", timeout)
+		}
+		for _, stmt := range stmts {
+			fmt.Print(stmt)
+		}
+
+		if direction {
+			r, err := sqlSource(conf, src)
+			if err != nil {
+				return fmt.Errorf("%s: %w", m.name(), err)
+			}
+			verify, _, err := splitSQLSection(r, "Verify")
+			if err != nil {
+				return fmt.Errorf("%s: %w", m.name(), err)
+			}
+			for _, stmt := range verify {
+				fmt.Printf("-- would verify\n%s", stmt)
+			}
+		}
+	}
+
+	fmt.Printf("%s -- (%d, %v, %q, NULL)\n", strings.TrimSpace(conf.Driver.Dialect.InsertVersionSql(conf.quotedVersionTable())),
+		m.Version, direction, bytesChecksum(src))
+
+	return nil
+}
+
+// RedoOnDb rolls back the most recently applied migration,
+// then applies it again. If applying it again fails, the
+// migration is left rolled back.
+func RedoOnDb(conf *DBConf, db *sql.DB) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	current, err := EnsureDBVersion(conf, db)
+	if err != nil {
+		return err
+	}
+
+	if current == 0 {
+		return fmt.Errorf("%w, nothing to redo", ErrNoCurrentVersion)
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return err
+	}
+
+	var m *Migration
+	for _, candidate := range migrations {
+		if candidate.Version == current {
+			m = candidate
+			break
+		}
+	}
+
+	if m == nil {
+		return fmt.Errorf("no migration found for current version %d", current)
+	}
+
+	for _, direction := range []bool{false, true} {
+		if err = validateMigration(conf, m, direction); err != nil {
+			return err
+		}
+	}
+
+	logger.Printf("goose: redoing db environment '%v', current version: %d\n", conf.Env, current)
+
+	for _, direction := range []bool{false, true} {
+		start := time.Now()
+		if err = runMigration(conf, db, m, direction); err != nil {
+			return fmt.Errorf("FAIL %w, quitting migration", err)
+		}
+
+		logMigrated(conf, m, time.Since(start))
+	}
+
+	return nil
+}
+
+// Redo is RedoOnDb for the in-process API.
+func Redo(db *sql.DB, dirpath string) error {
+	return RedoOnDb(inProcessConf(dirpath), db)
+}
+
+// DownByOneOnDb rolls back the migration of the current version,
+// and only that one, however many others are applied. Nothing is
+// rolled back if its file is missing or has no Down section.
+func DownByOneOnDb(conf *DBConf, db *sql.DB) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	current, err := EnsureDBVersion(conf, db)
+	if err != nil {
+		return err
+	}
+
+	if current == 0 {
+		return fmt.Errorf("%w, nothing to roll back", ErrNoCurrentVersion)
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return err
+	}
+
+	var m *Migration
+	for _, candidate := range migrations {
+		if candidate.Version == current {
+			m = candidate
+			break
+		}
+	}
+
+	if m == nil {
+		return fmt.Errorf("no migration found for current version %d, can't roll it back", current)
+	}
+
+	irreversible, err := isIrreversible(conf, m)
+	if err != nil {
+		return err
+	}
+	if irreversible {
+		return fmt.Errorf("migration %d is irreversible, can't roll it back", current)
+	}
+
+	hasDown, err := hasDownMigration(conf, m)
+	if err != nil {
+		return err
+	}
+	if !hasDown {
+		return fmt.Errorf("%s has %w, can't roll back version %d",
+			m.name(), ErrMissingDownMigration, current)
+	}
+
+	if err = validateMigration(conf, m, false); err != nil {
+		return err
+	}
+
+	applied, err := GetAppliedMigrations(conf, db)
+	if err != nil {
+		return err
+	}
+
+	// the version that'll be current afterwards
+	target := int64(0)
+	for v, isApplied := range applied {
+		if isApplied && v < current && v > target {
+			target = v
+		}
+	}
+
+	logger.Printf("goose: migrating db environment '%v', current version: %d, target: %d%s\n",
+		conf.Env, current, target, runMode(conf))
+
+	start := time.Now()
+	if err = runMigration(conf, db, m, false); err != nil {
+		return fmt.Errorf("FAIL %w, quitting migration", err)
+	}
+
+	logMigrated(conf, m, time.Since(start))
+
+	return nil
+}
+
+// DownByOne is DownByOneOnDb for the in-process API.
+func DownByOne(db *sql.DB, dirpath string) error {
+	return DownByOneOnDb(inProcessConf(dirpath), db)
+}
+
+// DownToOnDb rolls back every applied migration newer than version,
+// newest first. Nothing is rolled back if any of them is missing
+// from disk or has no Down section. Rolling back to version 0
+// rolls back every applied migration.
+func DownToOnDb(conf *DBConf, db *sql.DB, version int64) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		return err
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return err
+	}
+
+	applied, err := GetAppliedMigrations(conf, db)
+	if err != nil {
+		return err
+	}
+
+	if err = checkRollback(conf, migrations, applied, version); err != nil {
+		return err
+	}
+
+	return runMigrations(conf, conf.MigrationsDir, version, db, "down")
+}
+
+// check that every migration applied after version
+// can be rolled back, before rolling any back
+func checkRollback(conf *DBConf, migrations []*Migration, applied map[int64]bool, version int64) error {
+
+	orphans := []int64{}
+	for _, v := range orphanedVersions(migrations, applied) {
+		if v > version {
+			orphans = append(orphans, v)
+		}
+	}
+	if len(orphans) > 0 {
+		return fmt.Errorf("no migration found for applied version(s) %v, can't roll them back", orphans)
+	}
+
+	for _, m := range migrationSorter(migrations).Todo(version, applied, "down") {
+		irreversible, err := isIrreversible(conf, m)
+		if err != nil {
+			return err
+		}
+		if irreversible {
+			return fmt.Errorf("migration %d is irreversible, can't roll back to version %d", m.Version, version)
+		}
+
+		hasDown, err := hasDownMigration(conf, m)
+		if err != nil {
+			return err
+		}
+		if !hasDown {
+			return fmt.Errorf("%s has %w, can't roll back version %d",
+				m.name(), ErrMissingDownMigration, m.Version)
+		}
+	}
+
+	return nil
+}
+
+// ResetOnDb rolls back every applied migration, newest first, to
+// version 0. Nothing is rolled back unless every applied migration
+// can be: each must have a Down section on disk. If dropTable is
+// set, the version table is dropped afterwards too.
+func ResetOnDb(conf *DBConf, db *sql.DB, dropTable bool) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		return err
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return err
+	}
+
+	applied, err := GetAppliedMigrations(conf, db)
+	if err != nil {
+		return err
+	}
+
+	if err = checkRollback(conf, migrations, applied, 0); err != nil {
+		return err
+	}
+
+	if err = runMigrations(conf, conf.MigrationsDir, 0, db, "down"); err != nil {
+		return err
+	}
+
+	if !dropTable {
 		return nil
-	})
+	}
+
+	drop := fmt.Sprintf("DROP TABLE %s;", conf.quotedVersionTable())
+	if conf.DryRun {
+		fmt.Println(drop)
+		return nil
+	}
+
+	if _, err = db.Exec(drop); err != nil {
+		return fmt.Errorf("dropping version table: %w", err)
+	}
+
+	logger.Printf("goose: dropped version table %s\n", conf.VersionTableName())
+
+	return nil
+}
+
+// Reset is ResetOnDb for the in-process API.
+func Reset(db *sql.DB, dirpath string, dropTable bool) error {
+	return ResetOnDb(inProcessConf(dirpath), db, dropTable)
+}
+
+// DownTo is DownToOnDb for the in-process API.
+func DownTo(db *sql.DB, dirpath string, version int64) error {
+	return DownToOnDb(inProcessConf(dirpath), db, version)
+}
+
+// ApplyVersionOnDb runs just the Up (if direction is true) or Down
+// of the migration for version, recording it as applied or rolled
+// back, whatever else has or hasn't been applied. It's intended for
+// tests that need the schema in a precise state.
+func ApplyVersionOnDb(conf *DBConf, db *sql.DB, version int64, direction bool) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		return err
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return err
+	}
+
+	var m *Migration
+	for _, candidate := range migrations {
+		if candidate.Version == version {
+			m = candidate
+			break
+		}
+	}
+
+	if m == nil {
+		return fmt.Errorf("no migration found for version %d", version)
+	}
+
+	applied, err := GetAppliedMigrations(conf, db)
+	if err != nil {
+		return err
+	}
+
+	if applied[version] == direction {
+		if direction {
+			return fmt.Errorf("version %d has already been applied", version)
+		}
+		return fmt.Errorf("version %d hasn't been applied, can't roll it back", version)
+	}
+
+	if err = validateMigration(conf, m, direction); err != nil {
+		return err
+	}
+
+	directionStr := "down"
+	if direction {
+		directionStr = "up"
+	}
+
+	logger.Printf("goose: applying %s of version %d to db environment '%v'\n", directionStr, version, conf.Env)
+
+	start := time.Now()
+	if err = runMigration(conf, db, m, direction); err != nil {
+		return fmt.Errorf("FAIL %w, quitting migration", err)
+	}
+
+	logMigrated(conf, m, time.Since(start))
+
+	return nil
+}
+
+// ApplyVersion is ApplyVersionOnDb for the in-process API.
+func ApplyVersion(db *sql.DB, dirpath string, version int64, direction bool) error {
+	return ApplyVersionOnDb(inProcessConf(dirpath), db, version, direction)
+}
+
+// EnsureVersionTableOnDb creates the version table, with its initial
+// version 0 record, if it doesn't already exist.
+func EnsureVersionTableOnDb(conf *DBConf, db *sql.DB) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	_, err := EnsureDBVersion(conf, db)
+	return err
+}
+
+// EnsureVersionTable is EnsureVersionTableOnDb for the in-process API.
+func EnsureVersionTable(db *sql.DB) error {
+	return EnsureVersionTableOnDb(inProcessConf(""), db)
+}
+
+// BaselineOnDb records every migration up to and including version as
+// applied, without running any of them, for adopting goose on a
+// database whose schema was built some other way. The version table
+// is created first if needed. Versions that are already applied are
+// left alone, so baselining more than once is harmless.
+func BaselineOnDb(conf *DBConf, db *sql.DB, version int64) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		return err
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return err
+	}
+
+	applied, err := GetAppliedMigrations(conf, db)
+	if err != nil {
+		return err
+	}
+
+	records, err := baselineRecords(conf, migrations, applied, version)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("goose: baselining db environment '%v' at version %d\n", conf.Env, version)
+
+	if conf.DryRun {
+		for _, rec := range records {
+			fmt.Printf("-- goose dry run: would record version %d as applied\n", rec.VersionId)
+		}
+		return nil
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		if err = RecordMigration(conf, txn, rec); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+// the records of the unapplied migrations up to version, in version
+// order, so that the baseline is recorded last
+func baselineRecords(conf *DBConf, migrations []*Migration, applied map[int64]bool, version int64) ([]MigrationRecord, error) {
+
+	// migrations are collected a directory at a time, with
+	// registered Go migrations last
+	sort.Sort(migrationSorter(migrations))
+
+	var records []MigrationRecord
+	for _, m := range migrations {
+		if m.Version > version || applied[m.Version] {
+			continue
+		}
+
+		src, err := readMigration(conf, m)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, MigrationRecord{VersionId: m.Version, IsApplied: true, Checksum: bytesChecksum(src)})
+	}
+
+	// the baseline itself may predate the migrations on disk
+	if !applied[version] && (len(records) == 0 || records[len(records)-1].VersionId != version) {
+		records = append(records, MigrationRecord{VersionId: version, IsApplied: true})
+	}
+
+	return records, nil
+}
+
+// Baseline is BaselineOnDb for the in-process API.
+func Baseline(db *sql.DB, dirpath string, version int64) error {
+	return BaselineOnDb(inProcessConf(dirpath), db, version)
+}
+
+// run the hook, if there is one, within txn
+func runHook(name string, hook MigrationHook, txn *sql.Tx, version int64, direction bool) error {
+	if hook == nil {
+		return nil
+	}
+	if err := hook(txn, version, direction); err != nil {
+		return fmt.Errorf("%s hook: %w", name, err)
+	}
+	return nil
+}
+
+// MigrationStatus describes whether a migration has been applied
+type MigrationStatus struct {
+	Version      int64
+	Name         string // file name of the migration, or "" if it has none
+	Applied      bool
+	AppliedAt    time.Time     // zero unless Applied
+	Duration     time.Duration // how long applying it took, or 0 if unknown
+	Irreversible bool          // declared as having no Down migration
+}
+
+// StatusOnDb reports the status of each migration found in
+// conf.MigrationsDir, plus any applied versions that no longer
+// have a migration, in version order.
+func StatusOnDb(conf *DBConf, db *sql.DB) ([]MigrationStatus, error) {
+
+	if err := checkVersioning(conf); err != nil {
+		return nil, err
+	}
+
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		return nil, err
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := latestVersionRecords(conf, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	for _, m := range migrations {
+		ms := MigrationStatus{Version: m.Version, Name: m.name()}
+		if ms.Irreversible, err = isIrreversible(conf, m); err != nil {
+			return nil, err
+		}
+		if rec, ok := records[m.Version]; ok && rec.IsApplied {
+			ms.Applied = true
+			ms.AppliedAt = rec.TStamp
+			ms.Duration = rec.Duration
+		}
+		status = append(status, ms)
+		delete(records, m.Version)
+	}
+
+	for v, rec := range records {
+		if rec.IsApplied && v != 0 {
+			status = append(status, MigrationStatus{Version: v, Applied: true, AppliedAt: rec.TStamp, Duration: rec.Duration})
+		}
+	}
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+
+	return status, nil
+}
+
+// Status is StatusOnDb for the in-process API.
+func Status(db *sql.DB, dirpath string) ([]MigrationStatus, error) {
+	return StatusOnDb(inProcessConf(dirpath), db)
+}
+
+// PendingOnDb returns the migrations found in conf.MigrationsDir
+// that haven't been applied, in version order. That includes any
+// older than the current version, which Up refuses to apply unless
+// conf.AllowMissing is set. It doesn't create the version table;
+// if there isn't one, every migration is pending.
+func PendingOnDb(conf *DBConf, db *sql.DB) ([]*Migration, error) {
+
+	if err := checkVersioning(conf); err != nil {
+		return nil, err
+	}
+
+	// the name is interpolated into SQL, so check it before using it
+	if err := validateVersionTable(conf.VersionTableName()); err != nil {
+		return nil, err
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := versionTableExists(conf, db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int64]bool{}
+	if exists {
+		if applied, err = GetAppliedMigrations(conf, db); err != nil {
+			return nil, err
+		}
+	}
+
+	return pendingMigrations(migrations, applied), nil
+}
+
+// the migrations that haven't been applied, in version order
+func pendingMigrations(migrations []*Migration, applied map[int64]bool) []*Migration {
+
+	var pending []*Migration
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+
+	sort.Sort(migrationSorter(pending))
+
+	return pending
+}
+
+// Pending is PendingOnDb for the in-process API.
+func Pending(db *sql.DB, dirpath string) ([]*Migration, error) {
+	return PendingOnDb(inProcessConf(dirpath), db)
+}
+
+// HasPendingOnDb reports whether any migration is pending,
+// as returned by PendingOnDb.
+func HasPendingOnDb(conf *DBConf, db *sql.DB) (bool, error) {
+
+	if err := checkVersioning(conf); err != nil {
+		return false, err
+	}
+
+	pending, err := PendingOnDb(conf, db)
+	return len(pending) > 0, err
+}
+
+// HasPending is HasPendingOnDb for the in-process API.
+func HasPending(db *sql.DB, dirpath string) (bool, error) {
+	return HasPendingOnDb(inProcessConf(dirpath), db)
+}
+
+// CheckOrphansOnDb returns the applied versions that have no
+// migration in conf.MigrationsDir, in version order, e.g. because
+// their files were deleted or renamed after they were applied.
+// They can't be rolled back. It doesn't create the version table;
+// if there isn't one, nothing is applied, so nothing is orphaned.
+func CheckOrphansOnDb(conf *DBConf, db *sql.DB) ([]int64, error) {
+
+	if err := checkVersioning(conf); err != nil {
+		return nil, err
+	}
+
+	// the name is interpolated into SQL, so check it before using it
+	if err := validateVersionTable(conf.VersionTableName()); err != nil {
+		return nil, err
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := versionTableExists(conf, db)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	applied, err := GetAppliedMigrations(conf, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return orphanedVersions(migrations, applied), nil
+}
+
+// the applied versions, other than 0, with no migration, in version order
+func orphanedVersions(migrations []*Migration, applied map[int64]bool) []int64 {
+
+	onDisk := make(map[int64]bool)
+	for _, m := range migrations {
+		onDisk[m.Version] = true
+	}
+
+	var orphans []int64
+	for v, isApplied := range applied {
+		if isApplied && v != 0 && !onDisk[v] {
+			orphans = append(orphans, v)
+		}
+	}
+
+	sort.Sort(int64Slice(orphans))
+
+	return orphans
+}
+
+// CheckOrphans is CheckOrphansOnDb for the in-process API.
+func CheckOrphans(db *sql.DB, dirpath string) ([]int64, error) {
+	return CheckOrphansOnDb(inProcessConf(dirpath), db)
+}
+
+// Ping checks that the database described by conf can be
+// connected to.
+func Ping(conf *DBConf) error {
+
+	db, err := OpenDBFromDBConf(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return pingDB(conf, db)
+}
+
+func pingDB(conf *DBConf, db *sql.DB) error {
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("couldn't connect to db environment '%v': %w", conf.Env, err)
+	}
+	return nil
+}
+
+// CheckPermissions pings the database described by conf, then
+// checks it can be migrated, as CheckPermissionsOnDb does.
+func CheckPermissions(conf *DBConf) error {
+
+	db, err := OpenDBFromDBConf(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err = pingDB(conf, db); err != nil {
+		return err
+	}
+
+	return CheckPermissionsOnDb(conf, db)
+}
+
+// CheckPermissionsOnDb checks, before anything is migrated, that
+// goose has the privileges to record migrations in the version
+// table: by inserting a row into it, in a transaction that's rolled
+// back, or if there's no version table yet, by creating a table
+// like it alongside, and dropping it again. Whether the migrations
+// themselves have the privileges they need can't be told in advance.
+func CheckPermissionsOnDb(conf *DBConf, db *sql.DB) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	// the name is interpolated into SQL, so check it before using it
+	if err := validateVersionTable(conf.VersionTableName()); err != nil {
+		return err
+	}
+
+	exists, err := versionTableExists(conf, db)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if conf.NoCreateVersionTable {
+			return fmt.Errorf("version table %s doesn't exist, and creating it is disabled", conf.VersionTableName())
+		}
+		return checkCreateTable(conf, db)
+	}
+
+	return checkVersionInsert(conf, db)
+}
+
+// create, and drop, a table like the version table, named after it
+func checkCreateTable(conf *DBConf, db *sql.DB) error {
+
+	probe := *conf
+	probe.VersionTable = conf.VersionTableName() + "_check"
+
+	if _, err := db.Exec(createVersionTableSql(&probe)); err != nil {
+		return fmt.Errorf("couldn't create version table %s, does the database user have permission to create tables? %w",
+			conf.VersionTableName(), err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("DROP TABLE %s", probe.quotedVersionTable())); err != nil {
+		return fmt.Errorf("created table %s to check permissions, but couldn't drop it: %w", probe.VersionTableName(), err)
+	}
+
+	return nil
+}
+
+// insert a row into the version table, and roll it back
+func checkVersionInsert(conf *DBConf, db *sql.DB) error {
+
+	d := conf.Driver.Dialect
+
+	// the row couldn't be rolled back, so just check the table can be read
+	if noTransactions(d) {
+		_, err := currentDBVersion(conf, db)
+		return err
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer txn.Rollback()
+
+	if _, err = txn.Exec(d.InsertVersionSql(conf.quotedVersionTable()), 0, encodeBool(d, true), nil, nil); err != nil {
+		return fmt.Errorf("couldn't write to version table %s, does the database user have permission to insert into it? %w",
+			conf.VersionTableName(), err)
+	}
+
+	return nil
+}
+
+// the most recent record for each version in the version table
+func latestVersionRecords(conf *DBConf, db *sql.DB) (map[int64]MigrationRecord, error) {
+
+	records := make(map[int64]MigrationRecord)
+
+	// a dry run doesn't create the version table, so it may not exist
+	if conf.DryRun {
+		exists, err := versionTableExists(conf, db)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return records, nil
+		}
+	}
+
+	history, err := GetDBVersionHistoryOnDb(conf, db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range history {
+		records[rec.VersionId] = rec
+	}
+
+	return records, nil
+}
+
+// GetDBVersionHistoryOnDb returns each migration applied or
+// rolled back, oldest first, along with when that happened.
+func GetDBVersionHistoryOnDb(conf *DBConf, db *sql.DB) ([]MigrationRecord, error) {
+
+	if err := checkVersioning(conf); err != nil {
+		return nil, err
+	}
+
+	rows, err := conf.Driver.Dialect.VersionHistoryQuery(db, conf.quotedVersionTable())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []MigrationRecord
+	for rows.Next() {
+		var (
+			rec        MigrationRecord
+			tstamp     sql.NullInt64
+			durationMs sql.NullInt64
+		)
+		if err = rows.Scan(&rec.VersionId, &rec.IsApplied, &tstamp, &durationMs); err != nil {
+			return nil, fmt.Errorf("error scanning rows: %w", err)
+		}
+
+		// version 0 is just where the table started
+		if rec.VersionId == 0 {
+			continue
+		}
+
+		if tstamp.Valid {
+			rec.TStamp = time.Unix(tstamp.Int64, 0).UTC()
+		}
+		if durationMs.Valid {
+			rec.Duration = time.Duration(durationMs.Int64) * time.Millisecond
+		}
+		history = append(history, rec)
+	}
+
+	return history, rows.Err()
+}
+
+// GetDBVersionHistory is GetDBVersionHistoryOnDb for the in-process API.
+func GetDBVersionHistory(db *sql.DB) ([]MigrationRecord, error) {
+	return GetDBVersionHistoryOnDb(inProcessConf(""), db)
+}
+
+// does the migration define how to roll it back?
+func hasDownMigration(conf *DBConf, m *Migration) (bool, error) {
+
+	if m.Registered {
+		return m.DownFn != nil || m.DownMetadataFn != nil, nil
+	}
+
+	src, err := readMigration(conf, m)
+	if err != nil {
+		return false, err
+	}
+
+	switch migrationExt(m.Source) {
+	case ".go":
+		return goHasFunc(src, fmt.Sprintf("Down_%d", m.Version)), nil
+
+	case ".sql":
+		return sqlHasAnnotation(src, "Down")
+	}
+
+	return false, nil
+}
+
+// ValidateConf checks every migration in conf.MigrationsDir without
+// running any: that versions are unique, and that each migration
+// parses and has an Up, along with a Down unless it's irreversible.
+// Migrations are checked this way before any are run anyway.
+func ValidateConf(conf *DBConf) error {
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err = validateMigration(conf, m, true); err != nil {
+			return err
+		}
+
+		irreversible, err := isIrreversible(conf, m)
+		if err != nil {
+			return err
+		}
+		if !irreversible {
+			if err = validateMigration(conf, m, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate is ValidateConf for the in-process API.
+func Validate(dirpath string) error {
+	return ValidateConf(inProcessConf(dirpath))
+}
+
+// CheckDownMigrationsOnDb applies each migration in turn to db, which
+// must be a scratch database that none have been applied to. Each SQL
+// migration that can be rolled back is rolled back and applied again,
+// and the versions of those whose Down doesn't restore the schema as
+// it was before their Up are returned, in version order. What differs
+// is logged. Only dialects that can dump a schema, such as postgres
+// and sqlite3, are supported.
+func CheckDownMigrationsOnDb(conf *DBConf, db *sql.DB) ([]int64, error) {
+
+	if err := checkVersioning(conf); err != nil {
+		return nil, err
+	}
+
+	dumper, ok := conf.Driver.Dialect.(schemaDumper)
+	if !ok {
+		return nil, fmt.Errorf("the %T dialect can't dump a schema to compare", conf.Driver.Dialect)
+	}
+	if conf.DryRun || conf.Fake {
+		return nil, errors.New("Down migrations can't be checked without running them")
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	if current, err := EnsureDBVersion(conf, db); err != nil {
+		return nil, err
+	} else if current != 0 {
+		return nil, fmt.Errorf("migrations have been applied to the scratch database, up to version %d", current)
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(migrationSorter(migrations))
+
+	var broken []int64
+	for _, m := range migrations {
+		check := migrationExt(m.Source) == ".sql"
+		if check {
+			irreversible, err := isIrreversible(conf, m)
+			if err != nil {
+				return broken, err
+			}
+			check = !irreversible
+		}
+
+		if !check {
+			start := time.Now()
+			if err = runMigration(conf, db, m, true); err != nil {
+				return broken, fmt.Errorf("FAIL %w", err)
+			}
+			logMigrated(conf, m, time.Since(start))
+			continue
+		}
+
+		before, err := dumper.DumpSchema(db)
+		if err != nil {
+			return broken, err
+		}
+		for _, direction := range []bool{true, false} {
+			if err = runMigration(conf, db, m, direction); err != nil {
+				return broken, fmt.Errorf("FAIL %w", err)
+			}
+		}
+		after, err := dumper.DumpSchema(db)
+		if err != nil {
+			return broken, err
+		}
+
+		if diff := schemaDiff(before, after); len(diff) > 0 {
+			logger.Printf("goose: %s: Down doesn't restore the schema:\n%s\n", m.name(), strings.Join(diff, "\n"))
+			broken = append(broken, m.Version)
+		}
+
+		// apply it again, for the migrations after it
+		start := time.Now()
+		if err = runMigration(conf, db, m, true); err != nil {
+			return broken, fmt.Errorf("FAIL %w, after rolling it back", err)
+		}
+		logMigrated(conf, m, time.Since(start))
+	}
+
+	return broken, nil
+}
+
+// the lines only in before, prefixed by "-", and those only
+// in after, prefixed by "+", in the order they appear
+func schemaDiff(before, after []string) []string {
+
+	count := func(lines []string) map[string]int {
+		n := make(map[string]int)
+		for _, l := range lines {
+			n[l]++
+		}
+		return n
+	}
+	inBefore, inAfter := count(before), count(after)
+
+	var diff []string
+	for _, l := range before {
+		if inAfter[l] > 0 {
+			inAfter[l]--
+		} else {
+			diff = append(diff, "- "+l)
+		}
+	}
+	for _, l := range after {
+		if inBefore[l] > 0 {
+			inBefore[l]--
+		} else {
+			diff = append(diff, "+ "+l)
+		}
+	}
+
+	return diff
+}
+
+// CheckDownMigrations is CheckDownMigrationsOnDb for the in-process API.
+func CheckDownMigrations(db *sql.DB, dirpath string) ([]int64, error) {
+	return CheckDownMigrationsOnDb(inProcessConf(dirpath), db)
+}
+
+// check that the migration can be run in the given direction,
+// as far as can be told without running it
+func validateMigration(conf *DBConf, m *Migration, direction bool) error {
+
+	directionStr := "Down"
+	if direction {
+		directionStr = "Up"
+	}
+
+	if m.Registered {
+		return nil
+	}
+
+	src, err := readMigration(conf, m)
+	if err != nil {
+		return err
+	}
+
+	switch migrationExt(m.Source) {
+	case ".go":
+		if bytes.Contains(src, []byte("goose.AddMigration(")) {
+			return fmt.Errorf("%s: registered via goose.AddMigration, so must be run from the program it's compiled into",
+				m.name())
+		}
+		if !goHasFunc(src, fmt.Sprintf("%s_%d", directionStr, m.Version)) {
+			return fmt.Errorf("%s: no %s_%d function", m.name(), directionStr, m.Version)
+		}
+
+	case ".sql":
+		r, err := sqlSource(conf, src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name(), err)
+		}
+		if _, _, err = splitSQLStatements(r, direction); err != nil {
+			return fmt.Errorf("%s: %w", m.name(), err)
+		}
+		if _, err = sqlTimeout(src); err != nil {
+			return fmt.Errorf("%s: %w", m.name(), err)
+		}
+		if _, _, err = sqlCondition(conf, src); err != nil {
+			return fmt.Errorf("%s: %w", m.name(), err)
+		}
+
+		hasSection, err := sqlHasAnnotation(src, directionStr)
+		if err != nil {
+			return err
+		}
+		if !hasSection {
+			return fmt.Errorf("%s: no '-- +goose %s' section", m.name(), directionStr)
+		}
+	}
+
+	return nil
+}
+
+// has the migration been declared irreversible? SQL migrations
+// declare it with an IRREVERSIBLE annotation, and registered Go
+// migrations by registering a nil Down function.
+func isIrreversible(conf *DBConf, m *Migration) (bool, error) {
+
+	if m.Registered {
+		return m.DownFn == nil && m.DownMetadataFn == nil, nil
+	}
+
+	if migrationExt(m.Source) != ".sql" {
+		return false, nil
+	}
+
+	src, err := readMigration(conf, m)
+	if err != nil {
+		return false, err
+	}
+
+	return sqlHasAnnotation(src, "IRREVERSIBLE")
+}
+
+// read the source of the migration, from conf's FS unless
+// it's a registered Go migration, whose source (if it's
+// still around) is wherever it was compiled from.
+// gzipped SQL migrations are decompressed.
+func readMigration(conf *DBConf, m *Migration) ([]byte, error) {
+	if m.section != nil {
+		return m.section, nil
+	}
+	if m.body != nil {
+		return m.body, nil
+	}
+	if m.Registered {
+		return ioutil.ReadFile(m.Source)
+	}
+
+	src, err := fs.ReadFile(migrationsFS(conf), m.Source)
+	if err != nil || !strings.HasSuffix(m.Source, gzipSQLExt) {
+		return src, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", m.Source, err)
+	}
+	if src, err = ioutil.ReadAll(zr); err != nil {
+		return nil, fmt.Errorf("%s: %w", m.Source, err)
+	}
+	return src, nil
+}
+
+// gzipped SQL migrations, for large seed data, end with this
+const gzipSQLExt = ".sql.gz"
+
+// the type of migration the file is, by its extension,
+// with gzipped SQL migrations counting as ".sql"
+func migrationExt(path string) string {
+	if strings.HasSuffix(path, gzipSQLExt) {
+		return ".sql"
+	}
+	return filepath.Ext(path)
+}
+
+// lockDB takes the dialect's lock on a connection of its own,
+// so that concurrent migration runs wait for one another.
+// The returned func releases the lock.
+func lockDB(conf *DBConf, db *sql.DB) (unlock func(), err error) {
+
+	// the name is interpolated into SQL, so check it before using it
+	table := conf.VersionTableName()
+	if err := validateVersionTable(table); err != nil {
+		return nil, err
+	}
+
+	d := conf.Driver.Dialect
+	if d.LockSql(table) == "" {
+		return func() {}, nil
+	}
+
+	// the lock's connection is held for the whole run,
+	// so nothing else could ever get a connection
+	if conf.MaxOpenConns == 1 {
+		return nil, errors.New("holding the migration lock needs a connection of its own, so MaxOpenConns must be at least 2")
+	}
+
+	// session locks must be released on the connection that took them
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, d.LockSql(table)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("acquiring migration lock: %w", err)
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(ctx, d.UnlockSql(table)); err != nil {
+			logger.Printf("WARNING: releasing migration lock: %v\n", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+// the FS that the in-process API reads migrations from,
+// or nil for the local filesystem
+var baseFS fs.FS
+
+// SetBaseFS sets the FS, such as an embed.FS, that the in-process
+// API reads migrations from. Pass nil to read from the local
+// filesystem again, which is the default.
+func SetBaseFS(fsys fs.FS) {
+	baseFS = fsys
+}
+
+// the conf used by the in-process API, such as Up()
+func inProcessConf(dirpath string) *DBConf {
+	return &DBConf{
+		MigrationsDir: dirpath,
+		Driver:        DBDriver{Dialect: defaultDialect},
+		FS:            baseFS,
+		Verbose:       verbose,
+	}
+}
+
+// Up applies all available migrations in dirpath to db.
+//
+// Go migrations are run in-process, and so must have been
+// registered via AddMigration. The dialect used to record
+// versions may be selected via SetDialect.
+func Up(db *sql.DB, dirpath string) error {
+	return UpOnDb(inProcessConf(dirpath), db)
+}
+
+// UpOnDb applies all available migrations in conf's migrations
+// directories to db, as Up does, but with the dialect and other
+// settings of conf.
+func UpOnDb(conf *DBConf, db *sql.DB) error {
+
+	target, err := upTarget(conf)
+	if err != nil {
+		return err
+	}
+
+	return RunMigrationsOnDb(conf, conf.MigrationsDir, target, db, "up")
+}
+
+// the most recent version of any of the migrations up would run,
+// from every directory of conf. unless `go run` can open the DB for
+// itself, as it can for the goose command, every Go migration must
+// be runnable in-process.
+func upTarget(conf *DBConf) (int64, error) {
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return 0, err
+	}
+
+	if conf.Driver.OpenStr == "" && conf.OpenStrFunc == nil {
+		if err = checkRegistered(migrations); err != nil {
+			return 0, err
+		}
+	}
+
+	target := int64(0)
+	for _, m := range migrations {
+		if m.Version > target {
+			target = m.Version
+		}
+	}
+	return target, nil
+}
+
+// UpByOnDb applies the next n pending migrations, as returned by
+// PendingOnDb, in version order, and stops. Each is applied and
+// recorded in a transaction of its own before the next begins.
+func UpByOnDb(conf *DBConf, db *sql.DB, n int) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	if n < 1 {
+		return fmt.Errorf("can't apply %d migrations, must be at least 1", n)
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	pending, err := PendingOnDb(conf, db)
+	if err != nil {
+		return err
+	}
+
+	// every pending migration up to the nth is applied, and no others
+	target := int64(0)
+	if len(pending) > 0 {
+		if n > len(pending) {
+			n = len(pending)
+		}
+		target = pending[n-1].Version
+	}
+
+	return runMigrations(conf, conf.MigrationsDir, target, db, "up")
+}
+
+// UpBy is UpByOnDb for the in-process API.
+func UpBy(db *sql.DB, dirpath string, n int) error {
+
+	conf := inProcessConf(dirpath)
+
+	migrations, err := collectMigrations(conf, dirpath)
+	if err != nil {
+		return err
+	}
+	if err = checkRegistered(migrations); err != nil {
+		return err
+	}
+
+	return UpByOnDb(conf, db, n)
+}
+
+// UpByOne applies the next pending migration in dirpath to db.
+func UpByOne(db *sql.DB, dirpath string) error {
+	return UpBy(db, dirpath, 1)
+}
+
+// the in-process API can only run Go migrations registered via AddMigration
+func checkRegistered(migrations []*Migration) error {
+	for _, m := range migrations {
+		if migrationExt(m.Source) == ".go" && !m.Registered {
+			return fmt.Errorf("%s: Go migrations must be registered via goose.AddMigration to run in-process",
+				m.name())
+		}
+	}
+	return nil
+}
+
+// collect all the valid looking migration scripts in the
+// migrations folder, and key them by version.
+// Go migrations registered via AddMigration are included
+// whether or not their source is present on disk.
+func GetMigrationsFromDisk(dirpath string, target int64) (m []*Migration, err error) {
+	return collectMigrations(&DBConf{}, dirpath)
+}
+
+// collectMigrations is GetMigrationsFromDisk for any number of
+// directories, merged, subject to the options in conf. More than one
+// file specifying the same version, in the same directory or not, is
+// an error, unless conf.AllowDuplicateVersions is set, in which case
+// the first file found is used. Migrations are read from conf.FS,
+// if it's set.
+func collectMigrations(conf *DBConf, dirpaths ...string) (m []*Migration, err error) {
+
+	// ensure we only have one migration per version
+	add := func(nm *Migration) error {
+		for _, g := range m {
+			if nm.Version == g.Version {
+				if !conf.AllowDuplicateVersions {
+					return fmt.Errorf("%w: more than one file specifies the migration for version %d (%s and %s)",
+						ErrDuplicateVersion, nm.Version, g.Source, nm.Source)
+				}
+				logger.Printf("WARNING: more than one file specifies the migration for version %d, ignoring %s\n",
+					nm.Version, nm.name())
+				return nil
+			}
+		}
+		m = append(m, nm)
+		return nil
+	}
+
+	for _, pattern := range conf.IgnorePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("ignore pattern %q: %w", pattern, err)
+		}
+	}
+
+	// extract the numeric component of each migration,
+	// and filter out any uninteresting files
+	for _, dirpath := range dirpaths {
+		err = fs.WalkDir(migrationsFS(conf), dirpath, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if name != dirpath && isIgnored(conf, dirpath, name) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			if d.IsDir() && isOtherEnvDir(conf, dirpath, name) {
+				return fs.SkipDir
+			}
+
+			v, e := NumericComponent(name)
+			if e == nil {
+				return add(newMigration(v, name))
+			}
+
+			// likely a mistake, unless it's listed in IgnorePatterns
+			if !d.IsDir() && migrationExt(name) == ".sql" {
+				logger.Printf("goose: skipping %s: %v\n", name, e)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.MigrationsFile != "" {
+		if filepath.Ext(conf.MigrationsFile) != ".sql" {
+			return nil, fmt.Errorf("%s: a combined file of migrations must be .sql", conf.MigrationsFile)
+		}
+
+		src, err := fs.ReadFile(migrationsFS(conf), conf.MigrationsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		sections, err := splitCombinedMigrations(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(conf.MigrationsFile), err)
+		}
+
+		for _, s := range sections {
+			cm := newMigration(s.version, conf.MigrationsFile)
+			cm.section = s.src
+			if err = add(cm); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, rm := range registeredGoMigrations {
+		found := false
+		for i, g := range m {
+			if g.Version == rm.Version {
+				m[i] = rm
+				found = true
+				break
+			}
+		}
+		if !found {
+			m = append(m, rm)
+		}
+	}
+
+	// `go run` needs the migration's source on the local filesystem
+	if conf.FS != nil {
+		for _, g := range m {
+			if migrationExt(g.Source) == ".go" && !g.Registered {
+				return nil, fmt.Errorf("%s: Go migrations read from an FS must be registered via goose.AddMigration",
+					filepath.Base(g.Source))
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// is name the directory, within dirpath, of an environment other
+// than conf's, whose migrations are left out?
+func isOtherEnvDir(conf *DBConf, dirpath, name string) bool {
+	return conf.EnvDirs && name != dirpath &&
+		path.Dir(name) == path.Clean(dirpath) && path.Base(name) != conf.Env
+}
+
+// missingMigrations returns the versions of any migrations that
+// have not been applied, but are older than the most recently
+// applied version. These typically arrive via a merge, after
+// newer migrations have already been run.
+func missingMigrations(migrations []*Migration, applied map[int64]bool) []int64 {
+
+	max := int64(0)
+	for v, isApplied := range applied {
+		if isApplied && v > max {
+			max = v
+		}
+	}
+
+	missing := []int64{}
+	for _, m := range migrations {
+		if m.Version < max && !applied[m.Version] {
+			missing = append(missing, m.Version)
+		}
+	}
+
+	sort.Sort(int64Slice(missing))
+
+	return missing
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+
+func (ms migrationSorter) Sort(direction string) {
+
+	// sort ascending or descending by version
+	if direction == "up" {
+		sort.Sort(ms)
+	} else {
+		sort.Sort(sort.Reverse(ms))
+	}
+
+	// now that we're sorted in the appropriate direction,
+	// populate next and previous for each migration
+	for i, m := range ms {
+		prev := int64(-1)
+		if i > 0 {
+			prev = ms[i-1].Version
+			ms[i-1].Next = m.Version
+		}
+		ms[i].Previous = prev
+	}
+}
+
+func (ms migrationSorter) Todo(target int64, applied map[int64]bool, direction string) []*Migration {
+
+	ms.Sort(direction)
+
+	migrations := []*Migration{}
+
+	for _, m := range ms {
+		if shouldApplyMigration(m, target, applied, direction) {
+			migrations = append(migrations, m)
+		}
+	}
+
+	return migrations
+}
+
+func shouldApplyMigration(m *Migration, target int64, applied map[int64]bool, direction string) bool {
+	if direction == "down" {
+		return m.Version > target && applied[m.Version]
+	} else if direction == "up" {
+		return m.Version <= target && !applied[m.Version]
+	}
+
+	panic("Invalid direction: " + direction)
+}
+
+// is the file or directory at name, found while walking the
+// migrations directory dirpath, matched by conf.IgnorePatterns?
+func isIgnored(conf *DBConf, dirpath, name string) bool {
+
+	rel := strings.TrimPrefix(name, strings.TrimSuffix(dirpath, "/")+"/")
+	if dirpath == "." {
+		rel = name
+	}
+
+	for _, pattern := range conf.IgnorePatterns {
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// look for migration scripts with names in the form:
+//  XXX_descriptivename.ext
+// where XXX specifies the version number
+// and ext specifies the type of migration.
+// SQL migrations may be gzipped, as XXX_descriptivename.sql.gz
+func NumericComponent(name string) (int64, error) {
+
+	base := filepath.Base(name)
+
+	if ext := migrationExt(base); ext != ".go" && ext != ".sql" {
+		return 0, errors.New("not a recognized migration file type")
+	}
+
+	idx := strings.Index(base, "_")
+	if idx < 0 {
+		return 0, errors.New("no separator found")
+	}
+
+	n, e := strconv.ParseInt(base[:idx], 10, 64)
+	if e == nil && n <= 0 {
+		return 0, errors.New("migration IDs must be greater than zero")
+	}
+
+	return n, e
+}
+
+// ResolveVersion returns the version that target names: either the
+// version itself, e.g. 20130106093224, or the filename of one of the
+// migrations in conf.MigrationsDir, e.g. 20130106093224_add_user.sql,
+// which is an error if there's no such migration.
+func ResolveVersion(conf *DBConf, target string) (int64, error) {
+
+	if v, err := strconv.ParseInt(target, 10, 64); err == nil {
+		return v, nil
+	}
+
+	name := filepath.Base(target)
+	v, err := NumericComponent(name)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a version nor a migration filename: %w", target, err)
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range migrations {
+		if m.Version == v && filepath.Base(m.Source) == name {
+			return v, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no migration %s in %v", name, conf.MigrationsDir)
+}
+
+// GetAppliedMigrations returns whether each version recorded in the
+// version table is applied, according to its latest row, so that the
+// versions that are pending can be told apart from those applied
+// whatever order they were applied in, not just from the latest.
+func GetAppliedMigrations(conf *DBConf, db *sql.DB) (map[int64]bool, error) {
+	versions := make(map[int64]bool)
+
+	// a dry run doesn't create the version table, so it may not exist
+	if conf.DryRun {
+		exists, err := versionTableExists(conf, db)
+		if err != nil {
+			return versions, err
+		}
+		if !exists {
+			return versions, nil
+		}
+	}
+
+	// rows are newest first, ordered by id rather than tstamp,
+	// which may be the same for rows recorded in quick succession
+	rows, err := conf.Driver.Dialect.DbVersionQuery(db, conf.quotedVersionTable())
+	if err != nil {
+		return versions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row MigrationRecord
+		if err = rows.Scan(&row.VersionId, &row.IsApplied); err != nil {
+			return versions, fmt.Errorf("error scanning rows: %w", err)
+		}
+
+		if _, seen := versions[row.VersionId]; !seen {
+			versions[row.VersionId] = row.IsApplied
+		}
+	}
+
+	return versions, rows.Err()
+}
+
+// retrieve the current version for this DB.
+// Create and initialize the DB version table if it doesn't exist.
+func EnsureDBVersion(conf *DBConf, db *sql.DB) (int64, error) {
+
+	if err := checkVersioning(conf); err != nil {
+		return 0, err
+	}
+
+	// the name is interpolated into SQL, so check it before using it
+	if err := validateVersionTable(conf.VersionTableName()); err != nil {
+		return 0, err
+	}
+
+	exists, err := versionTableExists(conf, db)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if conf.NoCreateVersionTable {
+			return 0, fmt.Errorf("version table %s doesn't exist, and creating it is disabled; create it, with an applied row for version_id 0, using:\n%s",
+				conf.VersionTableName(), createVersionTableSql(conf))
+		}
+		if conf.DryRun {
+			fmt.Println("-- goose dry run: would create the version table")
+			return 0, nil
+		}
+		if err = createVersionTable(conf, db); err != nil {
+			return 0, fmt.Errorf("couldn't create version table %s, does the database user have permission to create tables? %w",
+				conf.VersionTableName(), err)
+		}
+		return 0, nil
+	}
+
+	if err := ensureVersionColumns(conf, db); err != nil {
+		return 0, err
+	}
+
+	return currentDBVersion(conf, db)
+}
+
+// the most recently applied version recorded in an existing version table
+func currentDBVersion(conf *DBConf, db *sql.DB) (int64, error) {
+
+	rows, err := conf.Driver.Dialect.DbVersionQuery(db, conf.quotedVersionTable())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	// The most recent record for each migration specifies
+	// whether it has been applied or rolled back.
+	// The first version we find that has been applied is the current version.
+
+	toSkip := make([]int64, 0)
+
+	for rows.Next() {
+		var row MigrationRecord
+		if err = rows.Scan(&row.VersionId, &row.IsApplied); err != nil {
+			return 0, fmt.Errorf("error scanning rows: %w", err)
+		}
+
+		// have we already marked this version to be skipped?
+		skip := false
+		for _, v := range toSkip {
+			if v == row.VersionId {
+				skip = true
+				break
+			}
+		}
+
+		if skip {
+			continue
+		}
+
+		// if version has been applied we're done
+		if row.IsApplied {
+			return row.VersionId, nil
+		}
+
+		// latest version of migration has not been applied.
+		toSkip = append(toSkip, row.VersionId)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, errors.New("no applied version found in the version table")
+}
+
+// Create the version table
+// and insert the initial 0 value into it
+func createVersionTable(conf *DBConf, db *sql.DB) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	d := conf.Driver.Dialect
+
+	if _, err := txn.Exec(createVersionTableSql(conf)); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	version := 0
+	applied := true
+	if _, err := txn.Exec(d.InsertVersionSql(conf.quotedVersionTable()), version, encodeBool(d, applied), nil, nil); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// the dialect's statement to create the version table,
+// with any VersionTableOptions appended to it
+func createVersionTableSql(conf *DBConf) string {
+
+	stmt := conf.Driver.Dialect.CreateVersionTableSql(conf.quotedVersionTable())
+	if conf.VersionTableOptions == "" {
+		return stmt
+	}
+
+	stmt = strings.TrimSpace(stmt)
+	if strings.HasSuffix(stmt, ";") {
+		return strings.TrimSuffix(stmt, ";") + " " + conf.VersionTableOptions + ";"
+	}
+	return stmt + " " + conf.VersionTableOptions
+}
+
+// wrapper for EnsureDBVersion for callers that don't already have
+// their own DB instance
+func GetDBVersion(conf *DBConf) (version int64, err error) {
+
+	db, err := OpenDBFromDBConf(conf)
+	if err != nil {
+		return -1, err
+	}
+	defer db.Close()
+
+	version, err = EnsureDBVersion(conf, db)
+	if err != nil {
+		return -1, err
+	}
+
+	return version, nil
+}
+
+// GetDBVersionOnDb returns the current version of db, as recorded
+// in its version table by the dialect of conf, without running or
+// changing anything. If there's no version table yet, the version
+// is 0, just as if the table had been created.
+func GetDBVersionOnDb(conf *DBConf, db *sql.DB) (int64, error) {
+
+	if err := checkVersioning(conf); err != nil {
+		return 0, err
+	}
+
+	// the name is interpolated into SQL, so check it before using it
+	if err := validateVersionTable(conf.VersionTableName()); err != nil {
+		return 0, err
+	}
+
+	exists, err := versionTableExists(conf, db)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	return currentDBVersion(conf, db)
+}
+
+// CurrentDBVersion is GetDBVersionOnDb for the in-process API.
+func CurrentDBVersion(db *sql.DB) (int64, error) {
+	return GetDBVersionOnDb(inProcessConf(""), db)
+}
+
+func GetPreviousDBVersion(dirpath string, version int64) (previous int64, err error) {
+	return GetPreviousDBVersionInDirs([]string{dirpath}, version)
+}
+
+// GetPreviousDBVersionInDirs is GetPreviousDBVersion across
+// several directories of migrations.
+func GetPreviousDBVersionInDirs(dirpaths []string, version int64) (previous int64, err error) {
+
+	previous = -1
+	sawGivenVersion := false
+
+	for _, dirpath := range dirpaths {
+		filepath.Walk(dirpath, func(name string, info os.FileInfo, walkerr error) error {
+			if walkerr != nil {
+				return walkerr
+			}
+
+			if !info.IsDir() {
+				if v, e := NumericComponent(name); e == nil {
+					if v > previous && v < version {
+						previous = v
+					}
+					if v == version {
+						sawGivenVersion = true
+					}
+				}
+			}
+
+			return nil
+		})
+	}
 
 	if previous == -1 {
 		if sawGivenVersion {
@@ -354,24 +2604,32 @@ func GetPreviousDBVersion(dirpath string, version int64) (previous int64, err er
 // helper to identify the most recent possible version
 // within a folder of migration scripts
 func GetMostRecentDBVersion(dirpath string) (version int64, err error) {
+	return GetMostRecentDBVersionInDirs([]string{dirpath})
+}
+
+// GetMostRecentDBVersionInDirs is GetMostRecentDBVersion across
+// several directories of migrations.
+func GetMostRecentDBVersionInDirs(dirpaths []string) (version int64, err error) {
 
 	version = -1
 
-	filepath.Walk(dirpath, func(name string, info os.FileInfo, walkerr error) error {
-		if walkerr != nil {
-			return walkerr
-		}
+	for _, dirpath := range dirpaths {
+		filepath.Walk(dirpath, func(name string, info os.FileInfo, walkerr error) error {
+			if walkerr != nil {
+				return walkerr
+			}
 
-		if !info.IsDir() {
-			if v, e := NumericComponent(name); e == nil {
-				if v > version {
-					version = v
+			if !info.IsDir() {
+				if v, e := NumericComponent(name); e == nil {
+					if v > version {
+						version = v
+					}
 				}
 			}
-		}
 
-		return nil
-	})
+			return nil
+		})
+	}
 
 	if version == -1 {
 		err = errors.New("no valid version found")
@@ -380,36 +2638,410 @@ func GetMostRecentDBVersion(dirpath string) (version int64, err error) {
 	return
 }
 
-func CreateMigration(name, migrationType, dir string, t time.Time) (path string, err error) {
+// schemes for numbering new migrations
+const (
+	TimestampVersioning  = "timestamp"  // UTC time of creation, e.g. 20130106093224
+	SequentialVersioning = "sequential" // one more than the latest sequential version
+)
+
+// timestamp versions always sort after sequential ones
+const minTimestampVersion = 19700101000000
+
+// CreateMigration writes a new migration of the given type to dir,
+// numbered according to versioning. If versioning is empty, it's
+// detected from the most recent migration already in dir, defaulting
+// to TimestampVersioning.
+//
+// A "go" migration registers its functions via AddMigration, to be
+// compiled into the application. "go-run" writes a .go migration of
+// the older kind instead, defining Up_ and Down_ functions for goose
+// to run via `go run`.
+func CreateMigration(name, migrationType, dir string, t time.Time, versioning string) (path string, err error) {
+	return CreateMigrationFromTemplate(name, migrationType, dir, t, versioning, nil)
+}
+
+// MigrationTemplateData is what the template of a new migration is
+// executed with. Version is the migration's version without any
+// padding, as Go migration functions are named, e.g. Up_20130106093224.
+type MigrationTemplateData struct {
+	Version int64
+	Name    string
+	Package string // for registered Go migrations, named for dir
+}
+
+// CreateMigrationFromTemplate is CreateMigration, except that the new
+// migration is written by executing tmpl with MigrationTemplateData,
+// rather than from goose's own skeleton for migrationType, unless
+// tmpl is nil.
+func CreateMigrationFromTemplate(name, migrationType, dir string, t time.Time, versioning string, tmpl *template.Template) (path string, err error) {
+
+	ext := migrationType
+	switch migrationType {
+	case "go", "sql":
+	case "go-run":
+		ext = "go"
+	default:
+		return "", errors.New("migration type must be 'go', 'go-run' or 'sql'")
+	}
 
-	if migrationType != "go" && migrationType != "sql" {
-		return "", errors.New("migration type must be 'go' or 'sql'")
+	version, err := NextVersionAt(dir, t, versioning)
+	if err != nil {
+		return "", err
 	}
 
-	timestamp := t.Format("20060102150405")
-	filename := fmt.Sprintf("%v_%v.%v", timestamp, name, migrationType)
+	filename := fmt.Sprintf("%s_%v.%v", FormatVersion(version), name, ext)
 
 	fpath := filepath.Join(dir, filename)
 
-	var tmpl *template.Template
-	if migrationType == "sql" {
-		tmpl = sqlMigrationTemplate
-	} else {
-		tmpl = goMigrationTemplate
+	if tmpl == nil {
+		switch migrationType {
+		case "sql":
+			tmpl = sqlMigrationTemplate
+		case "go-run":
+			tmpl = goMigrationTemplate
+		default:
+			tmpl = registeredGoMigrationTemplate
+		}
 	}
 
-	path, err = writeTemplateToFile(fpath, tmpl, timestamp)
+	// Go migration functions are named for the version without any padding
+	path, err = writeTemplateToFile(fpath, tmpl, MigrationTemplateData{
+		Version: version,
+		Name:    name,
+		Package: goPackageName(dir),
+	})
 
 	return
 }
 
+// NextVersion is the version that CreateMigration would give
+// a migration created in dir now, detecting the versioning
+// from the migrations already there.
+func NextVersion(dir string) (int64, error) {
+	return NextVersionAt(dir, time.Now(), "")
+}
+
+// NextVersionAt is the version that CreateMigration would give a
+// migration created in dir at t, numbered according to versioning,
+// which is detected as it is by CreateMigration if it's empty.
+func NextVersionAt(dir string, t time.Time, versioning string) (int64, error) {
+
+	migrations, err := collectMigrations(&DBConf{}, dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if versioning == "" {
+		versioning = TimestampVersioning
+		if latest := latestVersion(migrations, -1); latest > 0 && latest < minTimestampVersion {
+			versioning = SequentialVersioning
+		}
+	}
+
+	switch versioning {
+	case TimestampVersioning:
+		return strconv.ParseInt(t.UTC().Format("20060102150405"), 10, 64)
+	case SequentialVersioning:
+		return latestVersion(migrations, minTimestampVersion) + 1, nil
+	}
+	return 0, fmt.Errorf("versioning must be '%s' or '%s'", TimestampVersioning, SequentialVersioning)
+}
+
+// FormatVersion formats version as the file names of new
+// migrations begin, with sequential versions padded to 5 digits
+func FormatVersion(version int64) string {
+	return fmt.Sprintf("%05d", version)
+}
+
+// the package for registered Go migrations in dir, named for
+// the directory itself where that's a valid identifier.
+func goPackageName(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		if name := filepath.Base(abs); token.IsIdentifier(name) {
+			return name
+		}
+	}
+	return "migrations"
+}
+
+// the latest version among migrations that is below limit,
+// or 0 if there are none. a negative limit means no limit.
+func latestVersion(migrations []*Migration, limit int64) int64 {
+	latest := int64(0)
+	for _, m := range migrations {
+		if m.Version > latest && (limit < 0 || m.Version < limit) {
+			latest = m.Version
+		}
+	}
+	return latest
+}
+
+// FixOnDb renumbers the migrations with timestamp versions to follow
+// on sequentially from the latest sequential version, in the order
+// they were created, keeping their names, e.g. 20130106093224_add_user.sql
+// becomes 00004_add_user.sql. The Up_ and Down_ functions of Go
+// migrations are renamed to match. It's for tidying up the migrations
+// of a branch before it's released, so it refuses to renumber any
+// that have already been applied to the DB, which it only reads.
+func FixOnDb(conf *DBConf, db *sql.DB) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	if conf.FS != nil {
+		return errors.New("can't renumber migrations read from an FS")
+	}
+
+	migrations, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		return err
+	}
+
+	// without a version table, nothing has been applied
+	applied := map[int64]bool{}
+	exists, err := versionTableExists(conf, db)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if applied, err = GetAppliedMigrations(conf, db); err != nil {
+			return err
+		}
+	}
+
+	return fixMigrations(conf, migrations, applied)
+}
+
+// Fix is FixOnDb for the in-process API.
+func Fix(db *sql.DB, dirpath string) error {
+	return FixOnDb(inProcessConf(dirpath), db)
+}
+
+func fixMigrations(conf *DBConf, migrations []*Migration, applied map[int64]bool) error {
+
+	sort.Sort(migrationSorter(migrations))
+
+	var timestamped []*Migration
+	for _, m := range migrations {
+		if m.Version < minTimestampVersion {
+			continue
+		}
+		if m.section != nil {
+			return fmt.Errorf("can't renumber %s: it's one of several migrations in %s", m.name(), m.Source)
+		}
+		if applied[m.Version] {
+			return fmt.Errorf("can't renumber %s: version %d has already been applied", m.name(), m.Version)
+		}
+		timestamped = append(timestamped, m)
+	}
+
+	if len(timestamped) == 0 {
+		logger.Printf("goose: no timestamp versioned migrations to renumber\n")
+		return nil
+	}
+
+	// work out every new name before renaming any
+	// file, so that a conflict leaves them all alone
+	next := latestVersion(migrations, minTimestampVersion) + 1
+	targets := make([]string, len(timestamped))
+	for i, m := range timestamped {
+		base := filepath.Base(m.Source)
+		targets[i] = filepath.Join(filepath.Dir(m.Source), FormatVersion(next+int64(i))+base[strings.Index(base, "_"):])
+		if _, err := os.Stat(targets[i]); err == nil {
+			return fmt.Errorf("can't renumber %s: %s already exists", m.name(), targets[i])
+		}
+	}
+
+	for i, m := range timestamped {
+		if conf.DryRun {
+			fmt.Printf("-- goose dry run: would rename %s to %s\n", m.Source, targets[i])
+			continue
+		}
+
+		if err := renumberMigration(m, targets[i], next+int64(i)); err != nil {
+			return err
+		}
+		logger.Printf("goose: renamed %s to %s\n", m.Source, targets[i])
+	}
+
+	return nil
+}
+
+// Go migration functions named for the version, e.g. Up_20130106093224
+// for go run, or up_20130106093224 as registered by goose's own skeleton
+func goMigrationFuncRegexp(version int64) *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprintf(`\b(Up|Down|up|down)_%d\b`, version))
+}
+
+// move m to target, renaming its Go functions for version
+func renumberMigration(m *Migration, target string, version int64) error {
+
+	if migrationExt(m.Source) != ".go" {
+		return os.Rename(m.Source, target)
+	}
+
+	src, err := ioutil.ReadFile(m.Source)
+	if err != nil {
+		return err
+	}
+	src = goMigrationFuncRegexp(m.Version).ReplaceAll(src, []byte(fmt.Sprintf("${1}_%d", version)))
+
+	info, err := os.Stat(m.Source)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(target, src, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Remove(m.Source)
+}
+
 // Update the version table for the given migration,
 // and finalize the transaction.
 func FinalizeMigration(conf *DBConf, txn *sql.Tx, direction bool, v int64) error {
+	return FinalizeMigrationRecord(conf, txn, MigrationRecord{VersionId: v, IsApplied: direction})
+}
+
+// Like FinalizeMigration, but also records the checksum
+// of the migration's source, if rec has one.
+func FinalizeMigrationRecord(conf *DBConf, txn *sql.Tx, rec MigrationRecord) error {
+
+	if err := RecordMigration(conf, txn, rec); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// RecordMigration inserts the version table row for rec within txn,
+// leaving the transaction for the caller to commit or roll back.
+// This lets tests run a migration's statements and record it within
+// a transaction of their own, inspect the result, then discard it.
+//
+// Statements of migrations annotated NO TRANSACTION aren't run within
+// a transaction, so rolling back txn won't undo them.
+func RecordMigration(conf *DBConf, txn *sql.Tx, rec MigrationRecord) error {
+
+	var checksum sql.NullString
+	if rec.Checksum != "" {
+		checksum = sql.NullString{String: rec.Checksum, Valid: true}
+	}
+
+	var durationMs sql.NullInt64
+	if rec.Duration > 0 {
+		durationMs = sql.NullInt64{Int64: rec.Duration.Milliseconds(), Valid: true}
+	}
+
+	d := conf.Driver.Dialect
+	args := []interface{}{rec.VersionId, encodeBool(d, rec.IsApplied), checksum, durationMs}
+
+	// XXX: drop version table on some minimum version number?
+	stmt := d.InsertVersionSql(conf.quotedVersionTable())
+
+	// dialects that can't keep metadata are only asked to when there's some
+	if len(rec.Metadata) > 0 {
+		ms, ok := d.(metadataStore)
+		if !ok {
+			return fmt.Errorf("can't record the metadata of version %d: dialect %T doesn't support it",
+				rec.VersionId, d)
+		}
+		stmt = ms.InsertVersionMetadataSql(conf.quotedVersionTable())
+		args = append(args, string(rec.Metadata))
+	}
 
-	// XXX: drop goose_db_version table on some minimum version number?
-	stmt := conf.Driver.Dialect.insertVersionSql()
-	if _, err := txn.Exec(stmt, v, direction); err != nil {
+	if conf.AfterRecord == nil {
+		_, err := txn.Exec(stmt, args...)
+		return err
+	}
+
+	// the id of the row is only read back for the hook
+	if r, ok := d.(idReturner); ok {
+		if err := txn.QueryRow(r.ReturningId(stmt), args...).Scan(&rec.Id); err != nil {
+			return err
+		}
+	} else if _, err := txn.Exec(stmt, args...); err != nil {
+		return err
+	}
+
+	return conf.AfterRecord(txn, rec)
+}
+
+// SetDBVersionOnDb records version as applied, without running its
+// migration. It's an escape hatch, for reconciling the version table
+// with changes made to the schema by hand, e.g. while recovering from
+// an incident: migrations normally record themselves as they're run.
+func SetDBVersionOnDb(conf *DBConf, db *sql.DB, version int64) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	return stampDBVersion(conf, db, version, "recording version %d as applied", func(txn *sql.Tx) error {
+		return RecordMigration(conf, txn, MigrationRecord{VersionId: version, IsApplied: true})
+	})
+}
+
+// SetDBVersion is SetDBVersionOnDb for the in-process API.
+func SetDBVersion(db *sql.DB, version int64) error {
+	return SetDBVersionOnDb(inProcessConf(""), db, version)
+}
+
+// DeleteDBVersionOnDb removes every record of version from the
+// version table, so that it's as if its migration had never been run,
+// without rolling it back. Like SetDBVersionOnDb, it's an escape hatch.
+func DeleteDBVersionOnDb(conf *DBConf, db *sql.DB, version int64) error {
+
+	if err := checkVersioning(conf); err != nil {
+		return err
+	}
+
+	return stampDBVersion(conf, db, version, "deleting the records of version %d", func(txn *sql.Tx) error {
+		_, err := txn.Exec(conf.Driver.Dialect.DeleteVersionSql(conf.quotedVersionTable()), version)
+		return err
+	})
+}
+
+// DeleteDBVersion is DeleteDBVersionOnDb for the in-process API.
+func DeleteDBVersion(db *sql.DB, version int64) error {
+	return DeleteDBVersionOnDb(inProcessConf(""), db, version)
+}
+
+// change the version table's records of version by hand, with stamp,
+// which does what the format string desc describes
+func stampDBVersion(conf *DBConf, db *sql.DB, version int64, desc string, stamp func(txn *sql.Tx) error) error {
+
+	// version 0 is the version table's own initial record
+	if version <= 0 {
+		return fmt.Errorf("%d is not a valid migration version", version)
+	}
+
+	if conf.Lock {
+		unlock, err := lockDB(conf, db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if _, err := EnsureDBVersion(conf, db); err != nil {
+		return err
+	}
+
+	logger.Printf("goose: "+desc+"\n", version)
+
+	if conf.DryRun {
+		fmt.Println("-- goose dry run: leaving the version table as it is")
+		return nil
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err = stamp(txn); err != nil {
 		txn.Rollback()
 		return err
 	}
@@ -417,6 +3049,152 @@ func FinalizeMigration(conf *DBConf, txn *sql.Tx, direction bool, v int64) error
 	return txn.Commit()
 }
 
+// hex SHA-256 of the file at path
+func fileChecksum(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return bytesChecksum(b), nil
+}
+
+func bytesChecksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// make sure that none of the applied migrations has been
+// edited since it was applied, by comparing the checksum
+// recorded when it was applied against its source on disk.
+// versions recorded without a checksum, by an older goose,
+// or whose source is no longer around, aren't checked.
+func verifyChecksums(conf *DBConf, db *sql.DB, migrations []*Migration) error {
+
+	// nothing has been recorded yet if a dry run didn't create the table
+	if conf.DryRun {
+		exists, err := hasVersionColumn(conf, db, "checksum")
+		if err != nil || !exists {
+			return err
+		}
+	}
+
+	recorded, err := appliedChecksums(conf, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		want, ok := recorded[m.Version]
+		if !ok {
+			continue
+		}
+
+		src, err := readMigration(conf, m)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		got := bytesChecksum(src)
+
+		if got != want {
+			return fmt.Errorf("%s has changed since it was applied: recorded checksum %s, current checksum %s",
+				m.name(), want, got)
+		}
+	}
+
+	return nil
+}
+
+// the checksums recorded for each currently applied version
+func appliedChecksums(conf *DBConf, db *sql.DB) (map[int64]string, error) {
+
+	// rows are inserted in order, so the latest row
+	// for each version says whether it's applied
+	rows, err := conf.Driver.Dialect.ChecksumQuery(db, conf.quotedVersionTable())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := make(map[int64]string)
+	for rows.Next() {
+		var (
+			v        int64
+			applied  bool
+			checksum sql.NullString
+		)
+		if err = rows.Scan(&v, &applied, &checksum); err != nil {
+			return nil, err
+		}
+
+		if applied && checksum.Valid {
+			checksums[v] = checksum.String
+		} else {
+			delete(checksums, v)
+		}
+	}
+
+	return checksums, rows.Err()
+}
+
+// does the version table have the named column?
+func hasVersionColumn(conf *DBConf, db *sql.DB, name string) (bool, error) {
+	exists, err := conf.Driver.Dialect.ColumnExists(db, conf.VersionTableName(), name)
+	if err != nil {
+		return false, fmt.Errorf("couldn't check for the %s column of version table %s: %w", name, conf.VersionTableName(), err)
+	}
+	return exists, nil
+}
+
+// does the version table exist yet?
+func versionTableExists(conf *DBConf, db *sql.DB) (bool, error) {
+	exists, err := conf.Driver.Dialect.TableExists(db, conf.VersionTableName())
+	if err != nil {
+		return false, fmt.Errorf("couldn't check for version table %s: %w", conf.VersionTableName(), err)
+	}
+	return exists, nil
+}
+
+// columns of the version table added since it was first
+// created, and their types, in the order they were added
+var addedVersionColumns = []struct{ name, sqlType string }{
+	{"checksum", "VARCHAR(64)"},
+	{"duration_ms", "BIGINT"},
+	{"metadata", "TEXT"},
+}
+
+// version tables created by an older goose
+// need any columns added since then adding
+func ensureVersionColumns(conf *DBConf, db *sql.DB) error {
+	for _, col := range addedVersionColumns {
+		exists, err := hasVersionColumn(conf, db, col.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if conf.NoCreateVersionTable {
+			return fmt.Errorf("version table %s has no %s column, and altering it is disabled; add it using:\n%s",
+				conf.VersionTableName(), col.name, conf.Driver.Dialect.AddColumnSql(conf.quotedVersionTable(), col.name, col.sqlType))
+		}
+
+		if conf.DryRun {
+			fmt.Printf("-- goose dry run: would add the %s column to the version table\n", col.name)
+			continue
+		}
+
+		if _, err := db.Exec(conf.Driver.Dialect.AddColumnSql(conf.quotedVersionTable(), col.name, col.sqlType)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 var goMigrationTemplate = template.Must(template.New("goose.go-migration").Parse(`
 package main
 
@@ -425,13 +3203,37 @@ import (
 )
 
 // Up is executed when this migration is applied
-func Up_{{ . }}(txn *sql.Tx) {
+func Up_{{ .Version }}(txn *sql.Tx) {
 
 }
 
 // Down is executed when this migration is rolled back
-func Down_{{ . }}(txn *sql.Tx) {
+func Down_{{ .Version }}(txn *sql.Tx) {
+
+}
+`))
+
+var registeredGoMigrationTemplate = template.Must(template.New("goose.registered-go-migration").Parse(`
+package {{ .Package }}
+
+import (
+	"database/sql"
 
+	"github.com/superhuman/goose/lib/goose"
+)
+
+func init() {
+	goose.AddMigration(up_{{ .Version }}, down_{{ .Version }})
+}
+
+// up_{{ .Version }} is executed when this migration is applied
+func up_{{ .Version }}(txn *sql.Tx) error {
+	return nil
+}
+
+// down_{{ .Version }} is executed when this migration is rolled back
+func down_{{ .Version }}(txn *sql.Tx) error {
+	return nil
 }
 `))
 
@@ -1,7 +1,26 @@
 package goose
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"text/template"
+	"time"
 )
 
 func TestMigrationMapSortUp(t *testing.T) {
@@ -38,6 +57,856 @@ func TestMigrationMapSortDown(t *testing.T) {
 	validateMigrationSort(t, ms, sorted)
 }
 
+func TestRegisteredMigrationsFromDisk(t *testing.T) {
+
+	// pretend the sample Go migration has been compiled in
+	rm := newMigration(20130106222315, "20130106222315_and_again.go")
+	rm.Registered = true
+	registeredGoMigrations[rm.Version] = rm
+	defer delete(registeredGoMigrations, rm.Version)
+
+	ms, err := GetMigrationsFromDisk("../../db-sample/migrations", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ms) != 3 {
+		t.Fatalf("incorrect number of migrations. got %v, want %v", len(ms), 3)
+	}
+
+	for _, m := range ms {
+		if m.Registered != (m.Version == rm.Version) {
+			t.Errorf("incorrect Registered for version %v. got %v", m.Version, m.Registered)
+		}
+	}
+}
+
+func TestEnvDirs(t *testing.T) {
+
+	up := &fstest.MapFile{Data: []byte("-- +goose Up\nSELECT 1;\n")}
+	fsys := fstest.MapFS{
+		"migrations/001_first.sql":                  up,
+		"migrations/development/002_seed_posts.sql": up,
+		"migrations/production/003_seed_flags.sql":  up,
+		"migrations/development/more/004_seed.sql":  up,
+		"migrations/005_second.sql":                 up,
+	}
+
+	tests := []struct {
+		conf *DBConf
+		want []int64
+	}{
+		{&DBConf{FS: fsys, Env: "development", EnvDirs: true}, []int64{1, 2, 4, 5}},
+		{&DBConf{FS: fsys, Env: "production", EnvDirs: true}, []int64{1, 3, 5}},
+		{&DBConf{FS: fsys, Env: "test", EnvDirs: true}, []int64{1, 5}},
+		// every subdirectory is collected, unless EnvDirs is set
+		{&DBConf{FS: fsys, Env: "test"}, []int64{1, 2, 3, 4, 5}},
+	}
+
+	for _, test := range tests {
+		ms, err := collectMigrations(test.conf, "migrations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(migrationSorter(ms))
+
+		var got []int64
+		for _, m := range ms {
+			got = append(got, m.Version)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: bad migrations. got %v, want %v", test.conf.Env, got, test.want)
+		}
+	}
+}
+
+func TestMigrationSources(t *testing.T) {
+
+	rm := newMigration(20130106222315, "20130106222315_and_again.go")
+	rm.Registered = true
+	registeredGoMigrations[rm.Version] = rm
+	defer delete(registeredGoMigrations, rm.Version)
+
+	conf := &DBConf{}
+	body := "-- +goose Up\nSELECT 1;\n"
+
+	ms, err := sourceMigrations(conf, []MigrationSource{
+		{Name: "001_first.sql", Body: strings.NewReader(body)},
+		{Version: 2, Name: "second.sql", Body: strings.NewReader(body)},
+		{Name: "20130106222315_and_again.go", IsGo: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ms) != 3 || ms[0].Version != 1 || ms[1].Version != 2 || ms[2] != rm {
+		t.Fatalf("bad migrations from sources: %v", ms)
+	}
+	if ms[1].name() != "second.sql" {
+		t.Errorf("bad name. got %q", ms[1].name())
+	}
+	if src, err := readMigration(conf, ms[0]); err != nil || string(src) != body {
+		t.Errorf("bad source. got %q, %v", src, err)
+	}
+
+	bad := [][]MigrationSource{
+		{{Name: "003_third.go", IsGo: true}},
+		{{Name: "third.sql", Body: strings.NewReader(body)}},
+		{{Name: "003_third.txt", Body: strings.NewReader(body)}},
+		{{Name: "003_third.sql"}},
+		{{Name: "003_third.sql", Body: strings.NewReader(body)}, {Version: 3, Name: "again.sql", Body: strings.NewReader(body)}},
+	}
+	for i, sources := range bad {
+		if _, err := sourceMigrations(conf, sources); err == nil {
+			t.Errorf("%d: expected an error for sources %v", i, sources)
+		}
+	}
+}
+
+func TestMigrationsFromFS(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"migrations/001_first.sql":  {Data: []byte("-- +goose Up\nSELECT 1;\n")},
+		"migrations/002_second.sql": {Data: []byte("-- +goose Up\nSELECT 2;\n-- +goose Down\nSELECT 1;\n")},
+	}
+	conf := &DBConf{FS: fsys}
+
+	ms, err := collectMigrations(conf, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 {
+		t.Fatalf("incorrect number of migrations. got %v, want %v", len(ms), 2)
+	}
+
+	hasDown, err := hasDownMigration(conf, ms[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasDown {
+		t.Errorf("expected %v to have a Down section", ms[1].Source)
+	}
+
+	// unregistered Go migrations can't be run from an FS
+	fsys["migrations/003_third.go"] = &fstest.MapFile{Data: []byte("package main\n")}
+	if _, err := collectMigrations(conf, "migrations"); err == nil {
+		t.Error("expected an error for a Go migration in an FS")
+	}
+}
+
+func TestMultipleMigrationsDirs(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"billing/002_invoices.sql": {Data: []byte("-- +goose Up\nSELECT 2;\n")},
+		"search/001_index.sql":     {Data: []byte("-- +goose Up\nSELECT 1;\n")},
+		"search/003_reindex.sql":   {Data: []byte("-- +goose Up\nSELECT 3;\n")},
+	}
+	conf := &DBConf{FS: fsys, MigrationsDir: "billing", MigrationsDirs: []string{"search"}}
+
+	ms, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sorted := migrationSorter(ms).Todo(3, map[int64]bool{}, "up")
+	for i, want := range []int64{1, 2, 3} {
+		if sorted[i].Version != want {
+			t.Errorf("bad merged order. got %v at %d, want %v", sorted[i].Version, i, want)
+		}
+	}
+
+	// the same version in two directories
+	fsys["search/002_synonyms.sql"] = &fstest.MapFile{Data: []byte("-- +goose Up\nSELECT 2;\n")}
+	if _, err := collectMigrations(conf, conf.AllMigrationsDirs()...); err == nil {
+		t.Error("expected an error for a version in more than one directory")
+	}
+
+	// a directory that doesn't exist has no versions
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"001_index.sql", "003_reindex.sql"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("-- +goose Up\nSELECT 1;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs := []string{filepath.Join(dir, "nonesuch"), dir}
+	if v, err := GetPreviousDBVersionInDirs(dirs, 3); err != nil || v != 1 {
+		t.Errorf("bad previous version. got %v, %v", v, err)
+	}
+	if v, err := GetMostRecentDBVersionInDirs(dirs); err != nil || v != 3 {
+		t.Errorf("bad most recent version. got %v, %v", v, err)
+	}
+}
+
+func TestBaselineRecords(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"billing/002_invoices.sql": {Data: []byte("-- +goose Up\nSELECT 2;\n")},
+		"search/001_index.sql":     {Data: []byte("-- +goose Up\nSELECT 1;\n")},
+		"search/003_reindex.sql":   {Data: []byte("-- +goose Up\nSELECT 3;\n")},
+	}
+	conf := &DBConf{FS: fsys, MigrationsDir: "billing", MigrationsDirs: []string{"search"}}
+
+	tests := []struct {
+		version int64
+		applied map[int64]bool
+		want    []int64
+	}{
+		{2, map[int64]bool{0: true}, []int64{1, 2}},
+		{3, map[int64]bool{0: true, 1: true}, []int64{2, 3}},
+		{5, map[int64]bool{0: true}, []int64{1, 2, 3, 5}},
+		{2, map[int64]bool{0: true, 1: true, 2: true}, nil},
+	}
+
+	for _, test := range tests {
+		ms, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := baselineRecords(conf, ms, test.applied, test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, rec := range records {
+			got = append(got, rec.VersionId)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("baseline at %d: got versions %v, want %v", test.version, got, test.want)
+		}
+	}
+}
+
+func TestMigrationsFile(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"migrations/001_first.sql": {Data: []byte("-- +goose Up\nSELECT 1;\n")},
+		"schema.sql": {Data: []byte(`-- the rest of the schema
+
+-- +goose Version: 2
+-- +goose Up
+CREATE TABLE post (id int);
+-- +goose Down
+DROP TABLE post;
+
+-- +goose Version: 3
+-- +goose Up
+CREATE TABLE comment (id int);
+-- +goose Down
+DROP TABLE comment;
+`)},
+	}
+	conf := &DBConf{FS: fsys, MigrationsDir: "migrations", MigrationsFile: "schema.sql"}
+
+	ms, err := collectMigrations(conf, conf.AllMigrationsDirs()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sorted := migrationSorter(ms).Todo(3, map[int64]bool{}, "up")
+	if len(sorted) != 3 {
+		t.Fatalf("expected 3 migrations, got %d", len(sorted))
+	}
+
+	m := sorted[2]
+	if m.name() != "schema.sql#3" {
+		t.Errorf("incorrect name. got %v", m.name())
+	}
+
+	// each migration is just its own section of the file
+	stmts, _, err := splitSQLStatements(bytes.NewReader(m.section), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 1 || !strings.Contains(stmts[0], "DROP TABLE comment") {
+		t.Errorf("incorrect Down statements for version 3: %q", stmts)
+	}
+
+	// the same version in the file and a directory
+	fsys["migrations/002_second.sql"] = &fstest.MapFile{Data: []byte("-- +goose Up\nSELECT 2;\n")}
+	if _, err := collectMigrations(conf, conf.AllMigrationsDirs()...); err == nil {
+		t.Error("expected an error for a version in both the file and a directory")
+	}
+}
+
+func TestGzippedMigrations(t *testing.T) {
+
+	src := "-- +goose Up\nCREATE TABLE post (id int);\n-- +goose Down\nDROP TABLE post;\n"
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(src))
+	zw.Close()
+
+	fsys := fstest.MapFS{
+		"migrations/001_seed.sql.gz":   {Data: buf.Bytes()},
+		"migrations/002_notes.txt.gz":  {Data: buf.Bytes()},
+		"migrations/003_broken.sql.gz": {Data: []byte(src)},
+	}
+	conf := &DBConf{FS: fsys, MigrationsDir: "migrations"}
+
+	ms, err := collectMigrations(conf, conf.MigrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+
+	for _, m := range ms {
+		got, err := readMigration(conf, m)
+		switch m.Version {
+		case 1:
+			if err != nil || string(got) != src {
+				t.Errorf("incorrect source. got %q, %v", got, err)
+			}
+			if err = validateMigration(conf, m, true); err != nil {
+				t.Error(err)
+			}
+		case 3:
+			if err == nil {
+				t.Error("expected an error for a .sql.gz that isn't gzipped")
+			}
+		}
+	}
+}
+
+func TestIgnorePatterns(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"migrations/001_first.sql":          {Data: []byte("-- +goose Up\nSELECT 1;\n")},
+		"migrations/002_seed_helper.sql":    {Data: []byte("SELECT 2;\n")},
+		"migrations/helpers/003_macros.sql": {Data: []byte("SELECT 3;\n")},
+		"migrations/snippet.sql":            {Data: []byte("SELECT 4;\n")},
+	}
+	conf := &DBConf{FS: fsys, MigrationsDir: "migrations", IgnorePatterns: []string{"*_helper.sql", "helpers"}}
+
+	ms, err := collectMigrations(conf, conf.MigrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].Version != 1 {
+		t.Errorf("expected only version 1, got %v", ms)
+	}
+
+	conf.IgnorePatterns = []string{"[helpers"}
+	if _, err := collectMigrations(conf, conf.MigrationsDir); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+
+	conf := &DBConf{MigrationsDir: "../../db-sample/migrations"}
+
+	tests := map[string]int64{
+		"2":                           2,
+		"0":                           0,
+		"001_basics.sql":              1,
+		"20130106222315_and_again.go": 20130106222315,
+		"db/migrations/002_next.sql":  2,
+	}
+	for target, want := range tests {
+		if got, err := ResolveVersion(conf, target); err != nil || got != want {
+			t.Errorf("ResolveVersion(%q) = %d, %v, want %d", target, got, err, want)
+		}
+	}
+
+	// the file must exist, under the name given
+	for _, target := range []string{"003_missing.sql", "002_basics.sql", "basics", "v2"} {
+		if _, err := ResolveVersion(conf, target); err == nil {
+			t.Errorf("expected an error resolving %q", target)
+		}
+	}
+}
+
+func TestSchemaDiff(t *testing.T) {
+
+	before := []string{
+		"table post CREATE TABLE post (id int)",
+		"table goose_db_version CREATE TABLE goose_db_version (id int)",
+	}
+
+	// the Down forgot to drop the column added by the Up
+	after := []string{
+		"table post CREATE TABLE post (id int, title text)",
+		"table goose_db_version CREATE TABLE goose_db_version (id int)",
+	}
+
+	want := []string{"- table post CREATE TABLE post (id int)", "+ table post CREATE TABLE post (id int, title text)"}
+	if got := schemaDiff(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("bad schema diff.\ngot  %q\nwant %q", got, want)
+	}
+
+	if got := schemaDiff(before, before); len(got) != 0 {
+		t.Errorf("expected no differences, got %q", got)
+	}
+
+	// dialects that can't dump a schema can't be checked
+	conf := &DBConf{Driver: DBDriver{Dialect: &MySqlDialect{}}}
+	if _, err := CheckDownMigrationsOnDb(conf, nil); err == nil {
+		t.Error("expected an error for a dialect that can't dump a schema")
+	}
+}
+
+func TestFix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"00001_first.sql":              "-- +goose Up\nSELECT 1;\n",
+		"20130106222315_and_again.go":  "package main\n\nfunc Up_20130106222315(txn *sql.Tx) {\n}\n",
+		"20130106093224_add_user.sql":  "-- +goose Up\nSELECT 2;\n",
+		"20130107000000_add_posts.sql": "-- +goose Up\nSELECT 3;\n",
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ms, err := collectMigrations(&DBConf{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing's renamed if any of them has been applied
+	if err := fixMigrations(&DBConf{}, ms, map[int64]bool{20130106222315: true}); err == nil {
+		t.Error("expected an error renumbering an applied migration")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "20130106093224_add_user.sql")); err != nil {
+		t.Error(err)
+	}
+
+	if err := fixMigrations(&DBConf{}, ms, map[int64]bool{1: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err = collectMigrations(&DBConf{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(migrationSorter(ms))
+
+	want := []string{"00001_first.sql", "00002_add_user.sql", "00003_and_again.go", "00004_add_posts.sql"}
+	var got []string
+	for _, m := range ms {
+		got = append(got, filepath.Base(m.Source))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bad renumbering.\ngot  %v\nwant %v", got, want)
+	}
+
+	src, err := ioutil.ReadFile(filepath.Join(dir, "00003_and_again.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(src, []byte("func Up_3(")) {
+		t.Errorf("Go migration's function wasn't renamed:\n%s", src)
+	}
+}
+
+func TestDuplicateVersions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"001_first.sql", "002_second.sql", "002_other.sql"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(""), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := collectMigrations(&DBConf{}, dir); !errors.Is(err, ErrDuplicateVersion) {
+		t.Errorf("expected ErrDuplicateVersion, got %v", err)
+	}
+
+	ms, err := collectMigrations(&DBConf{AllowDuplicateVersions: true}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 {
+		t.Errorf("incorrect number of migrations. got %v, want %v", len(ms), 2)
+	}
+}
+
+func TestMissingMigrations(t *testing.T) {
+
+	ms := []*Migration{
+		newMigration(1, "test"),
+		newMigration(2, "test"),
+		newMigration(3, "test"),
+		newMigration(4, "test"),
+		newMigration(5, "test"),
+	}
+
+	applied := map[int64]bool{0: true, 1: true, 3: true, 4: false}
+
+	missing := missingMigrations(ms, applied)
+	want := []int64{2}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("incorrect missing migrations. got %v, want %v", missing, want)
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+
+	ms := []*Migration{
+		newMigration(4, "test"),
+		newMigration(1, "test"),
+		newMigration(3, "test"),
+		newMigration(2, "test"),
+	}
+
+	// 2 is older than the current version, 3 was rolled back
+	applied := map[int64]bool{0: true, 1: true, 3: false, 4: true}
+
+	var got []int64
+	for _, m := range pendingMigrations(ms, applied) {
+		got = append(got, m.Version)
+	}
+	if want := []int64{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect pending migrations. got %v, want %v", got, want)
+	}
+}
+
+func TestOrphanedVersions(t *testing.T) {
+
+	ms := []*Migration{
+		newMigration(4, "test"),
+		newMigration(1, "test"),
+	}
+
+	// 3 was rolled back before its file was deleted
+	applied := map[int64]bool{0: true, 1: true, 2: true, 3: false, 4: true, 5: true}
+
+	if got, want := orphanedVersions(ms, applied), []int64{2, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("incorrect orphaned versions. got %v, want %v", got, want)
+	}
+
+	if got := orphanedVersions(ms, map[int64]bool{0: true, 1: true}); len(got) != 0 {
+		t.Errorf("expected no orphaned versions, got %v", got)
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+
+	drv := &recordingDriver{}
+	sql.Register("goose-recording-preflight", drv)
+
+	conf := &DBConf{
+		Env:    "test",
+		Driver: DBDriver{Name: "goose-recording-preflight", Dialect: &missingTableDialect{}},
+	}
+	if err := Ping(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDBFromDBConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// without a version table, a table like it is created and dropped
+	if err = CheckPermissionsOnDb(conf, db); err != nil {
+		t.Fatal(err)
+	}
+	if len(drv.queries) != 2 || !strings.HasPrefix(drv.queries[0], `CREATE TABLE "goose_db_version_check"`) || drv.queries[1] != `DROP TABLE "goose_db_version_check"` {
+		t.Errorf("bad queries: %q", drv.queries)
+	}
+
+	conf.NoCreateVersionTable = true
+	if err = CheckPermissionsOnDb(conf, db); err == nil {
+		t.Error("expected an error when the version table can't be created")
+	}
+
+	if err = Ping(&DBConf{Driver: DBDriver{Name: "nonesuch"}}); err == nil {
+		t.Error("expected an error for an unknown driver")
+	}
+}
+
+// a dialect whose version table never exists
+type missingTableDialect struct {
+	PostgresDialect
+}
+
+func (d missingTableDialect) TableExists(db *sql.DB, table string) (bool, error) {
+	return false, nil
+}
+
+func TestEnsureVersionColumns(t *testing.T) {
+
+	drv := &recordingDriver{}
+	sql.Register("goose-recording-columns", drv)
+	db, err := sql.Open("goose-recording-columns", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a failed lookup isn't taken for a missing column
+	d := &missingColumnsDialect{err: errors.New("permission denied")}
+	conf := &DBConf{Driver: DBDriver{Dialect: d}}
+	if err = ensureVersionColumns(conf, db); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected the lookup's error, got %v", err)
+	}
+	if len(drv.queries) != 0 {
+		t.Errorf("expected no ALTER TABLE, got %q", drv.queries)
+	}
+
+	d.err = nil
+	if err = ensureVersionColumns(conf, db); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`ALTER TABLE "goose_db_version" ADD COLUMN checksum VARCHAR(64) NULL;`,
+		`ALTER TABLE "goose_db_version" ADD COLUMN duration_ms BIGINT NULL;`,
+		`ALTER TABLE "goose_db_version" ADD COLUMN metadata TEXT NULL;`,
+	}
+	if !reflect.DeepEqual(drv.queries, want) {
+		t.Errorf("bad queries. got %q, want %q", drv.queries, want)
+	}
+}
+
+// a dialect whose version table has none of the columns added
+// since it was first created, unless looking them up fails
+type missingColumnsDialect struct {
+	PostgresDialect
+	err error
+}
+
+func (d missingColumnsDialect) ColumnExists(db *sql.DB, table, column string) (bool, error) {
+	return false, d.err
+}
+
+func TestCreateMigrationVersioning(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t1 := time.Date(2013, 1, 6, 9, 32, 24, 0, time.UTC)
+	t2 := t1.Add(time.Second)
+
+	type testData struct {
+		name       string
+		when       time.Time
+		versioning string
+		filename   string
+	}
+
+	tests := []testData{
+		{"first", t1, SequentialVersioning, "00001_first.sql"},
+		{"second", t1, "", "00002_second.sql"},
+		{"third", t1, TimestampVersioning, "20130106093224_third.sql"},
+		{"fourth", t2, "", "20130106093225_fourth.sql"},
+		{"fifth", t2, SequentialVersioning, "00003_fifth.sql"},
+	}
+
+	for _, test := range tests {
+		// the version create will give is known beforehand
+		next, err := NextVersionAt(dir, test.when, test.versioning)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefix := FormatVersion(next) + "_"; !strings.HasPrefix(test.filename, prefix) {
+			t.Errorf("incorrect next version. got %v, want %v", prefix, test.filename)
+		}
+
+		path, err := CreateMigration(test.name, "sql", dir, test.when, test.versioning)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filepath.Base(path); got != test.filename {
+			t.Errorf("incorrect migration filename. got %v, want %v", got, test.filename)
+		}
+	}
+}
+
+func TestCreateMigrationFromTemplate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := template.Must(template.New("custom").Parse("-- {{ .Name }} {{ .Version }}\n-- +goose Up\n"))
+	when := time.Date(2013, 1, 6, 9, 32, 24, 0, time.UTC)
+
+	path, err := CreateMigrationFromTemplate("custom", "sql", dir, when, "", tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-- custom 20130106093224\n-- +goose Up\n"; string(b) != want {
+		t.Errorf("incorrect migration contents. got %q, want %q", b, want)
+	}
+}
+
+func TestCreateRegisteredGoMigration(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	when := time.Date(2013, 1, 6, 9, 32, 24, 0, time.UTC)
+
+	path, err := CreateMigration("registered", "go", dir, when, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Base(dir); f.Name.Name != want {
+		t.Errorf("incorrect package. got %v, want %v", f.Name.Name, want)
+	}
+
+	// the goose command can't run it via `go run`
+	m := newMigration(20130106093224, path)
+	if err := validateMigration(&DBConf{}, m, true); err == nil || !strings.Contains(err.Error(), "goose.AddMigration") {
+		t.Errorf("expected registered migration to be rejected, got %v", err)
+	}
+
+	if path, err = CreateMigration("go_run", "go-run", dir, when.Add(time.Second), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateMigration(&DBConf{}, newMigration(20130106093225, path), true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHasDownMigration(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upOnly := filepath.Join(dir, "003_up_only.sql")
+	if err := ioutil.WriteFile(upOnly, []byte("-- +goose Up\nSELECT 1;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type testData struct {
+		m       *Migration
+		hasDown bool
+	}
+
+	tests := []testData{
+		{m: newMigration(1, "../../db-sample/migrations/001_basics.sql"), hasDown: true},
+		{m: newMigration(20130106222315, "../../db-sample/migrations/20130106222315_and_again.go"), hasDown: true},
+		{m: newMigration(3, upOnly), hasDown: false},
+		{m: &Migration{Version: 4, Source: "004_registered.go", Registered: true}, hasDown: false},
+		{m: &Migration{Version: 5, Source: "005_registered.go", Registered: true,
+			DownMetadataFn: func(*sql.Tx, json.RawMessage) error { return nil }}, hasDown: true},
+	}
+
+	for _, test := range tests {
+		hasDown, err := hasDownMigration(&DBConf{}, test.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasDown != test.hasDown {
+			t.Errorf("incorrect hasDown for %v. got %v, want %v", test.m.Source, hasDown, test.hasDown)
+		}
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "001_checksum.sql")
+	if err := ioutil.WriteFile(path, []byte("-- +goose Up\nSELECT 1;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := fileChecksum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 64 {
+		t.Errorf("expected a hex SHA-256, got %q", before)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("-- +goose Up\nSELECT 2;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := fileChecksum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before {
+		t.Error("checksum didn't change when the file was edited")
+	}
+}
+
+func TestIrreversible(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "goose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	irreversible := filepath.Join(dir, "003_irreversible.sql")
+	src := "-- +goose Up\nALTER TABLE post DROP COLUMN body;\n-- +goose Down\n-- +goose IRREVERSIBLE\n"
+	if err := ioutil.WriteFile(irreversible, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		m            *Migration
+		irreversible bool
+	}{
+		{m: newMigration(1, "../../db-sample/migrations/001_basics.sql"), irreversible: false},
+		{m: newMigration(3, irreversible), irreversible: true},
+		{m: &Migration{Version: 4, Source: "004_registered.go", Registered: true}, irreversible: true},
+	}
+
+	for _, test := range tests {
+		got, err := isIrreversible(&DBConf{}, test.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.irreversible {
+			t.Errorf("incorrect irreversible for %v. got %v, want %v", test.m.Source, got, test.irreversible)
+		}
+	}
+
+	if err := runMigration(&DBConf{}, nil, tests[1].m, false); err == nil {
+		t.Error("expected an error rolling back an irreversible migration")
+	}
+}
+
 func validateMigrationSort(t *testing.T, ms migrationSorter, sorted []int64) {
 
 	for i, m := range ms {
@@ -69,3 +938,411 @@ func validateMigrationSort(t *testing.T, ms migrationSorter, sorted []int64) {
 
 	t.Log(ms)
 }
+
+func TestValidate(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"migrations/001_first.sql":  {Data: []byte("-- +goose Up\nSELECT 1;\n-- +goose Down\nSELECT 0;\n")},
+		"migrations/002_second.sql": {Data: []byte("-- +goose Up\nSELECT 2;\n-- +goose Down\nSELECT 1;\n")},
+	}
+	conf := &DBConf{FS: fsys, MigrationsDir: "migrations"}
+
+	if err := ValidateConf(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"no down", "-- +goose Up\nSELECT 2;\n"},
+		{"no up", "-- +goose Down\nSELECT 1;\n"},
+		{"unbalanced", "-- +goose Up\n-- +goose StatementBegin\nSELECT 2;\n-- +goose Down\nSELECT 1;\n"},
+	}
+
+	for _, test := range tests {
+		fsys["migrations/002_second.sql"] = &fstest.MapFile{Data: []byte(test.src)}
+		if err := ValidateConf(conf); err == nil {
+			t.Errorf("%s: expected a validation error", test.name)
+		}
+	}
+
+	// irreversible migrations don't need a Down section
+	fsys["migrations/002_second.sql"] = &fstest.MapFile{Data: []byte("-- +goose IRREVERSIBLE\n-- +goose Up\nSELECT 2;\n")}
+	if err := ValidateConf(conf); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckRollback(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"migrations/001_first.sql":  {Data: []byte("-- +goose Up\nSELECT 1;\n-- +goose Down\nSELECT 0;\n")},
+		"migrations/002_second.sql": {Data: []byte("-- +goose Up\nSELECT 2;\n")},
+	}
+	conf := &DBConf{FS: fsys}
+
+	ms, err := collectMigrations(conf, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkRollback(conf, ms, map[int64]bool{0: true, 1: true}, 0); err != nil {
+		t.Error(err)
+	}
+
+	// 002 has no Down section
+	if err := checkRollback(conf, ms, map[int64]bool{0: true, 1: true, 2: true}, 0); !errors.Is(err, ErrMissingDownMigration) {
+		t.Errorf("expected ErrMissingDownMigration for a migration with no Down section, got %v", err)
+	}
+
+	// 003 was applied, but isn't on disk
+	err = checkRollback(conf, ms, map[int64]bool{0: true, 1: true, 3: true}, 0)
+	if err == nil || !strings.Contains(err.Error(), "[3]") {
+		t.Errorf("expected an error naming the orphaned version. got %v", err)
+	}
+}
+
+func TestSkipGo(t *testing.T) {
+
+	ms := []*Migration{
+		newMigration(1, "001_first.sql"),
+		newMigration(2, "002_backfill.go"),
+		{Version: 3, Source: "003_registered.go", Registered: true},
+	}
+
+	kept := skipGoMigrations(ms, 3, map[int64]bool{}, "up")
+	if len(kept) != 2 || kept[0].Version != 1 || kept[1].Version != 3 {
+		t.Errorf("bad migrations kept: %v", kept)
+	}
+
+	// without a go command, migrations to be run via `go run` are named
+	conf := &DBConf{GoCommand: "/nonesuch/go"}
+	err := checkGoCommand(conf, ms)
+	if err == nil || !strings.Contains(err.Error(), "002_backfill.go") || strings.Contains(err.Error(), "003_registered.go") {
+		t.Errorf("expected an error naming 002_backfill.go, got %v", err)
+	}
+	if err := checkGoCommand(conf, kept); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrationError(t *testing.T) {
+
+	// a registered migration without a Down function is irreversible
+	m := &Migration{Version: 4, Source: "004_registered.go", Registered: true}
+	err := runMigration(&DBConf{}, nil, m, false)
+
+	var merr *MigrationError
+	if !errors.As(err, &merr) {
+		t.Fatalf("expected a *MigrationError, got %v", err)
+	}
+	if merr.Version != 4 || merr.Direction || merr.Source != m.Source {
+		t.Errorf("bad MigrationError: %+v", merr)
+	}
+	if err.Error() != "migration 4 is irreversible" {
+		t.Errorf("bad message: %v", err)
+	}
+}
+
+type recordingObserver struct {
+	events []string
+	panics bool
+}
+
+func (o *recordingObserver) OnMigrationStart(version int64, direction bool) {
+	o.events = append(o.events, fmt.Sprintf("start %d %v", version, direction))
+	if o.panics {
+		panic("observer failed")
+	}
+}
+
+func (o *recordingObserver) OnMigrationComplete(version int64, direction bool, duration time.Duration) {
+	o.events = append(o.events, fmt.Sprintf("complete %d %v", version, direction))
+}
+
+func (o *recordingObserver) OnMigrationError(version int64, direction bool, err error) {
+	var merr *MigrationError
+	o.events = append(o.events, fmt.Sprintf("error %d %v %v", version, direction, errors.As(err, &merr)))
+}
+
+func TestObserver(t *testing.T) {
+
+	m := &Migration{Version: 4, Source: "004_registered.go", Registered: true}
+
+	// a panicking observer doesn't change the outcome
+	for _, panics := range []bool{false, true} {
+		o := &recordingObserver{panics: panics}
+		err := runMigration(&DBConf{Observer: o}, nil, m, false)
+		if err == nil || err.Error() != "migration 4 is irreversible" {
+			t.Errorf("bad error: %v", err)
+		}
+		if want := []string{"start 4 false", "error 4 false true"}; !reflect.DeepEqual(o.events, want) {
+			t.Errorf("bad events. got %q, want %q", o.events, want)
+		}
+	}
+
+	// dry runs aren't observed
+	o := &recordingObserver{}
+	conf := &DBConf{Observer: o, DryRun: true, Driver: DBDriver{Dialect: &PostgresDialect{}}, FS: fstest.MapFS{"001_first.sql": {Data: []byte("-- +goose Up\nSELECT 1;\n")}}}
+	if err := runMigration(conf, nil, newMigration(1, "001_first.sql"), true); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.events) != 0 {
+		t.Errorf("expected no events for a dry run, got %q", o.events)
+	}
+}
+
+func TestNoVersioning(t *testing.T) {
+
+	conf := &DBConf{
+		NoVersioning:  true,
+		DryRun:        true,
+		MigrationsDir: ".",
+		Driver:        DBDriver{Dialect: &PostgresDialect{}},
+		FS: fstest.MapFS{
+			"001_roles.sql": {Data: []byte("-- +goose Up\nCREATE ROLE IF NOT EXISTS reader;\n")},
+			"002_ext.sql":   {Data: []byte("-- +goose Up\nCREATE EXTENSION IF NOT EXISTS pgcrypto;\n")},
+		},
+	}
+
+	// with no db, this only succeeds if the version table is left alone
+	if err := runMigrations(conf, conf.MigrationsDir, 2, nil, "up"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target    int64
+		direction string
+		fake      bool
+		err       string
+	}{
+		{0, "down", false, "only up can be run without versioning"},
+		{2, "up", true, "faking migrations records them, so needs versioning"},
+	}
+
+	for _, test := range tests {
+		conf.Fake = test.fake
+		err := runMigrations(conf, conf.MigrationsDir, test.target, nil, test.direction)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s to %d: got error %v, want %q", test.direction, test.target, err, test.err)
+		}
+	}
+
+	// everything else fails before touching the db
+	conf.Fake = false
+	for name, fn := range map[string]func() error{
+		"down":     func() error { return DownByOneOnDb(conf, nil) },
+		"redo":     func() error { return RedoOnDb(conf, nil) },
+		"reset":    func() error { return ResetOnDb(conf, nil, false) },
+		"baseline": func() error { return BaselineOnDb(conf, nil, 1) },
+		"fix":      func() error { return FixOnDb(conf, nil) },
+		"status":   func() error { _, err := StatusOnDb(conf, nil); return err },
+		"run down": func() error { return RunMigrationsOnDb(conf, conf.MigrationsDir, 0, nil, "down") },
+		"sources":  func() error { return RunMigrationSourcesOnDb(conf, nil, nil, 1, "up") },
+	} {
+		if err := fn(); !errors.Is(err, ErrNoVersioning) {
+			t.Errorf("%s: expected ErrNoVersioning, got %v", name, err)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+
+	drv := &recordingDriver{fail: "nonesuch"}
+	sql.Register("goose-recording-batch", drv)
+	db, err := sql.Open("goose-recording-batch", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	conf := &DBConf{
+		Batch:         true,
+		MigrationsDir: ".",
+		Driver:        DBDriver{Dialect: &PostgresDialect{}},
+		FS: fstest.MapFS{
+			"001_users.sql": {Data: []byte("-- +goose Up\nCREATE TABLE users (id int);\n")},
+			"002_posts.sql": {Data: []byte("-- +goose Up\nCREATE TABLE posts (author int REFERENCES nonesuch);\n")},
+			"003_tags.sql":  {Data: []byte("-- +goose Up\nCREATE TABLE tags (name text);\n")},
+		},
+	}
+	migrations, err := collectMigrations(conf, conf.MigrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := prepareBatch(conf, migrations, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed migration is rolled back to its savepoint, and the one
+	// before it committed, without running the one after it
+	err = runBatch(conf, db, batch, true)
+	var merr *MigrationError
+	if !errors.As(err, &merr) || merr.Version != 2 {
+		t.Fatalf("expected version 2 to fail, got %v", err)
+	}
+
+	// statements start with their migration's annotation
+	var got []string
+	for _, q := range drv.queries {
+		lines := strings.Split(strings.TrimSpace(q), "\n")
+		got = append(got, strings.Fields(lines[len(lines)-1])[0])
+	}
+	want := []string{"SAVEPOINT", "CREATE", "INSERT", "SAVEPOINT", "CREATE", "ROLLBACK", "COMMIT"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bad queries. got %q", drv.queries)
+	}
+	if q := drv.queries[5]; q != "ROLLBACK TO SAVEPOINT goose_2;" {
+		t.Errorf("bad rollback: %q", q)
+	}
+
+	// what can't be run within a savepoint is refused before anything is run
+	notx := &DBConf{
+		Driver: DBDriver{Dialect: &PostgresDialect{}},
+		FS:     fstest.MapFS{"004_index.sql": {Data: []byte("-- +goose NO TRANSACTION\n-- +goose Up\nCREATE INDEX CONCURRENTLY i ON users (id);\n")}},
+	}
+	for name, test := range map[string]struct {
+		conf *DBConf
+		m    *Migration
+	}{
+		"mysql":          {&DBConf{Driver: DBDriver{Dialect: &MySqlDialect{}}}, migrations[0]},
+		"go":             {conf, &Migration{Version: 4, Source: "004_seed.go"}},
+		"no transaction": {notx, &Migration{Version: 4, Source: "004_index.sql"}},
+	} {
+		if _, err := prepareBatch(test.conf, []*Migration{test.m}, true); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	for _, d := range []SqlDialect{&PostgresDialect{}, &CockroachDialect{}, &Sqlite3Dialect{}, &SqlServerDialect{}} {
+		if _, ok := d.(savepointer); !ok {
+			t.Errorf("%T: expected savepoints", d)
+		}
+	}
+}
+
+func TestUpTarget(t *testing.T) {
+
+	conf := &DBConf{
+		MigrationsDir:  "db/migrations",
+		MigrationsDirs: []string{"db/seeds"},
+		FS: fstest.MapFS{
+			"db/migrations/001_users.sql": {Data: []byte("-- +goose Up\nCREATE TABLE users (id int);\n")},
+			"db/migrations/002_posts.sql": {Data: []byte("-- +goose Up\nCREATE TABLE posts (id int);\n")},
+			"db/seeds/003_admin.sql":      {Data: []byte("-- +goose Up\nINSERT INTO users VALUES (1);\n")},
+		},
+	}
+
+	// the highest version may be in any of the directories
+	target, err := upTarget(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != 3 {
+		t.Errorf("bad target. got %d, want 3", target)
+	}
+
+	// as must every Go migration be registered
+	conf.FS.(fstest.MapFS)["db/seeds/004_admin.go"] = &fstest.MapFile{Data: []byte("package main\n")}
+	if _, err = upTarget(conf); err == nil {
+		t.Error("expected an error for an unregistered Go migration in the second directory")
+	}
+
+	// unless it can be run via `go run`, as by the goose command
+	dir := t.TempDir()
+	if err = ioutil.WriteFile(filepath.Join(dir, "005_seed.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	goRun := &DBConf{MigrationsDir: dir, Driver: DBDriver{OpenStr: "postgres://localhost/test"}}
+	if target, err = upTarget(goRun); err != nil || target != 5 {
+		t.Errorf("got target %d, error %v, want 5", target, err)
+	}
+}
+
+func TestStampDBVersion(t *testing.T) {
+
+	// bad versions are refused before the db is touched
+	for _, v := range []int64{0, -1} {
+		if err := SetDBVersion(nil, v); err == nil {
+			t.Errorf("expected an error setting version %d", v)
+		}
+		if err := DeleteDBVersion(nil, v); err == nil {
+			t.Errorf("expected an error deleting version %d", v)
+		}
+	}
+}
+
+func TestUpByCount(t *testing.T) {
+
+	// bad counts are refused before the db is touched
+	for _, n := range []int{0, -1} {
+		if err := UpByOnDb(&DBConf{}, nil, n); err == nil {
+			t.Errorf("expected an error applying %d migrations", n)
+		}
+	}
+}
+
+func TestGoRunCommand(t *testing.T) {
+
+	cmd := goRunCommand(&DBConf{}, "goose_main.go", "001_first.go")
+	if want := []string{"go", "run", "goose_main.go", "001_first.go"}; !reflect.DeepEqual(cmd.Args, want) || cmd.Env != nil {
+		t.Errorf("bad default command. got %v (env %v), want %v", cmd.Args, cmd.Env, want)
+	}
+
+	conf := &DBConf{
+		GoCommand:  "/opt/go/bin/go",
+		GoRunFlags: []string{"-mod=mod", "-tags=ci"},
+		GoRunEnv:   []string{"GOFLAGS=-mod=mod"},
+	}
+	cmd = goRunCommand(conf, "goose_main.go", "001_first.go")
+	if want := []string{"/opt/go/bin/go", "run", "-mod=mod", "-tags=ci", "goose_main.go", "001_first.go"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("bad configured command. got %v, want %v", cmd.Args, want)
+	}
+	if cmd.Env[len(cmd.Env)-1] != "GOFLAGS=-mod=mod" {
+		t.Errorf("expected GOFLAGS last in the environment, got %v", cmd.Env)
+	}
+}
+
+func TestGoRunTLS(t *testing.T) {
+
+	// go run is never reached, so nothing needs building
+	conf := &DBConf{TLSConfig: &tls.Config{}}
+	err := runGoMigration(conf, "nonesuch/001_first.go", 1, true)
+	if err == nil || !strings.Contains(err.Error(), "001_first.go: Go migrations run via go run can't connect with TLSConfig") {
+		t.Errorf("expected an error for TLSConfig, got %v", err)
+	}
+}
+
+func TestModuleVersion(t *testing.T) {
+
+	pkg := "github.com/superhuman/goose/lib/goose"
+
+	info := &debug.BuildInfo{
+		Main: debug.Module{Path: "example.com/app", Version: "(devel)"},
+		Deps: []*debug.Module{
+			{Path: "github.com/lib/pq", Version: "v1.10.9"},
+			{Path: "github.com/superhuman/goose", Version: "v1.2.0"},
+		},
+	}
+	if got := moduleVersion(info, pkg); got != "v1.2.0" {
+		t.Errorf("bad version of a dependency. got %q", got)
+	}
+
+	info.Deps[1].Replace = &debug.Module{Path: "../goose", Version: ""}
+	if got := moduleVersion(info, pkg); got != develVersion {
+		t.Errorf("bad version of a replaced dependency. got %q", got)
+	}
+
+	// goose's own build
+	info = &debug.BuildInfo{Main: debug.Module{Path: "github.com/superhuman/goose", Version: "v1.3.0"}}
+	if got := moduleVersion(info, pkg); got != "v1.3.0" {
+		t.Errorf("bad version of the main module. got %q", got)
+	}
+
+	if got := moduleVersion(&debug.BuildInfo{}, pkg); got != develVersion {
+		t.Errorf("bad version without build info. got %q", got)
+	}
+}
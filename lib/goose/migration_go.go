@@ -2,15 +2,19 @@ package goose
 
 import (
 	"bytes"
-	"encoding/gob"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"text/template"
+	"time"
 )
 
 type templateData struct {
@@ -20,6 +24,7 @@ type templateData struct {
 	Direction  bool
 	Func       string
 	InsertStmt string
+	Checksum   string
 }
 
 type SharedConf struct {
@@ -29,12 +34,14 @@ type SharedConf struct {
 	Env           string
 	MigrationsDir string
 	PgSchema      string
-}
+	Dialect       string
+	Placeholders  string
+	VersionTable  string
 
-func init() {
-	gob.Register(PostgresDialect{})
-	gob.Register(MySqlDialect{})
-	gob.Register(Sqlite3Dialect{})
+	MaxOpenConns    int
+	ConnMaxLifetime time.Duration
+	ConnectTimeout  time.Duration
+	SqlitePragmas   []string
 }
 
 //
@@ -46,25 +53,51 @@ func init() {
 //
 func runGoMigration(conf *DBConf, path string, version int64, direction bool) error {
 
-	// everything gets written to a temp dir, and zapped afterwards
+	// the config is only registered in this process, so the
+	// migration's own would connect without it
+	if conf.TLSConfig != nil {
+		return fmt.Errorf("%s: Go migrations run via go run can't connect with TLSConfig, register it via goose.AddMigration instead", filepath.Base(path))
+	}
+
+	// everything gets written to a temp dir, and zapped afterwards,
+	// unless `go run` fails, so that what it was given can be inspected
 	d, e := ioutil.TempDir("", "goose")
 	if e != nil {
-		log.Fatal(e)
+		return fmt.Errorf("creating temp dir: %w", e)
 	}
-	defer os.RemoveAll(d)
+	keep := false
+	defer func() {
+		if !keep {
+			os.RemoveAll(d)
+		}
+	}()
 
 	directionStr := "Down"
 	if direction {
 		directionStr = "Up"
 	}
 
+	// the migration's process can't call OpenStrFunc itself
+	open, e := conf.openStr()
+	if e != nil {
+		return e
+	}
+
 	sharedConf := SharedConf{
 		Name:          conf.Driver.Name,
-		OpenStr:       conf.Driver.OpenStr,
+		OpenStr:       open,
 		Import:        conf.Driver.Import,
 		Env:           conf.Env,
 		MigrationsDir: conf.MigrationsDir,
 		PgSchema:      conf.PgSchema,
+		Dialect:       dialectName(conf.Driver.Dialect),
+		Placeholders:  string(conf.Driver.Placeholders),
+		VersionTable:  conf.VersionTable,
+
+		MaxOpenConns:    conf.MaxOpenConns,
+		ConnMaxLifetime: conf.ConnMaxLifetime,
+		ConnectTimeout:  conf.ConnectTimeout,
+		SqlitePragmas:   conf.SqlitePragmas,
 	}
 
 	var bb bytes.Buffer
@@ -82,34 +115,287 @@ func runGoMigration(conf *DBConf, path string, version int64, direction bool) er
 	}
 	sb.WriteString("}")
 
+	checksum, e := fileChecksum(path)
+	if e != nil {
+		return fmt.Errorf("checksumming %s: %w", filepath.Base(path), e)
+	}
+
 	td := &templateData{
 		Version:    version,
 		Import:     conf.Driver.Import,
 		Conf:       sb.String(),
 		Direction:  direction,
 		Func:       fmt.Sprintf("%v_%v", directionStr, version),
-		InsertStmt: conf.Driver.Dialect.insertVersionSql(),
+		InsertStmt: conf.Driver.Dialect.InsertVersionSql(conf.quotedVersionTable()),
+		Checksum:   checksum,
 	}
 	main, e := writeTemplateToFile(filepath.Join(d, "goose_main.go"), goMigrationDriverTemplate, td)
 	if e != nil {
-		log.Fatal(e)
+		return fmt.Errorf("writing migration driver: %w", e)
 	}
 
 	outpath := filepath.Join(d, filepath.Base(path))
 	if _, e = copyFile(outpath, path); e != nil {
-		log.Fatal(e)
+		return fmt.Errorf("copying %s: %w", filepath.Base(path), e)
+	}
+
+	var stdout, stderrOut io.Writer = os.Stdout, os.Stderr
+	if conf.GoMigrationOutput != nil {
+		stdout, stderrOut = conf.GoMigrationOutput, conf.GoMigrationOutput
 	}
 
-	cmd := exec.Command("go", "run", main, outpath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// keep a copy of stderr so that failures can be reported to the caller
+	var stderr bytes.Buffer
+	cmd := goRunCommand(conf, main, outpath)
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderrOut, &stderr)
 	if e = cmd.Run(); e != nil {
-		log.Fatal("`go run` failed: ", e)
+		keep = true
+		return fmt.Errorf("`go run` of %s failed: %w\n%s\n(the generated driver and copied migration are kept in %s)",
+			filepath.Base(path), e, lastLines(stderr.String(), goMigrationErrorLines), d)
 	}
 
 	return nil
 }
 
+// the `go run` of the given files, as configured by conf
+func goRunCommand(conf *DBConf, files ...string) *exec.Cmd {
+
+	args := append(append([]string{"run"}, conf.GoRunFlags...), files...)
+
+	cmd := exec.Command(goCommand(conf), args...)
+	if len(conf.GoRunEnv) > 0 {
+		// later values of a variable take precedence
+		cmd.Env = append(os.Environ(), conf.GoRunEnv...)
+	}
+
+	return cmd
+}
+
+// the go command that runs Go migrations
+func goCommand(conf *DBConf) string {
+	if conf.GoCommand == "" {
+		return "go"
+	}
+	return conf.GoCommand
+}
+
+// is m run via `go run`, rather than in-process?
+func isGoRunMigration(m *Migration) bool {
+	return migrationExt(m.Source) == ".go" && !m.Registered
+}
+
+// with SkipGo, the migrations without those run via `go run`,
+// any of which that would otherwise have been run being logged
+func skipGoMigrations(migrations []*Migration, target int64, applied map[int64]bool, direction string) []*Migration {
+
+	var kept, skipped []*Migration
+	for _, m := range migrations {
+		if isGoRunMigration(m) {
+			skipped = append(skipped, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+
+	for _, m := range migrationSorter(skipped).Todo(target, applied, direction) {
+		logger.Printf("goose: skipping Go migration %s\n", m.name())
+	}
+
+	return kept
+}
+
+// fail before running anything if migrations include any to be run
+// via `go run`, but there's no go command to run them with
+func checkGoCommand(conf *DBConf, migrations []*Migration) error {
+
+	if conf.GoPlugin != "" || conf.Fake || conf.DryRun {
+		return nil
+	}
+
+	var names []string
+	for _, m := range migrations {
+		if isGoRunMigration(m) {
+			names = append(names, m.name())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	if _, err := exec.LookPath(goCommand(conf)); err != nil {
+		return fmt.Errorf("can't run Go migration(s) %s via `go run`: %w", strings.Join(names, ", "), err)
+	}
+	return nil
+}
+
+// how much of a failed Go migration's stderr to include in the error
+const goMigrationErrorLines = 20
+
+// the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// does the source of a .go migration define the named function,
+// e.g. Down_20130106222315?
+func goHasFunc(src []byte, name string) bool {
+	return bytes.Contains(src, []byte(fmt.Sprintf("func %s(", name)))
+}
+
+var errPluginsUnsupported = errors.New("Go plugins aren't supported on this platform")
+
+var registeredGoMigrations = map[int64]*Migration{}
+
+// AddMigration registers a Go migration to be run in-process,
+// rather than via `go run`. It's intended to be called from the
+// init() of the migration's source file, whose name supplies
+// the version in the usual XXX_descriptivename.go form.
+func AddMigration(up, down func(*sql.Tx) error) {
+	_, filename, _, _ := runtime.Caller(1)
+
+	m := registerGoMigration(filename)
+	m.UpFn = up
+	m.DownFn = down
+}
+
+// AddMigrationWithMetadata is AddMigration for a migration whose up
+// returns metadata, a small JSON document such as the ids of the rows
+// it backfilled, to be kept in the version table alongside its version,
+// and passed to its down when it's rolled back. up may return nil if
+// it has nothing to keep, and down is given nil if nothing was kept.
+func AddMigrationWithMetadata(up func(*sql.Tx) (json.RawMessage, error), down func(*sql.Tx, json.RawMessage) error) {
+	_, filename, _, _ := runtime.Caller(1)
+
+	m := registerGoMigration(filename)
+	m.UpMetadataFn = up
+	m.DownMetadataFn = down
+}
+
+func registerGoMigration(filename string) *Migration {
+	v, err := NumericComponent(filename)
+	if err != nil {
+		panic(fmt.Sprintf("goose: can't register %s: %v", filename, err))
+	}
+
+	if existing, ok := registeredGoMigrations[v]; ok {
+		panic(fmt.Sprintf("goose: more than one migration registered for version %d (%s and %s)",
+			v, existing.Source, filename))
+	}
+
+	m := newMigration(v, filename)
+	m.Registered = true
+	registeredGoMigrations[v] = m
+	return m
+}
+
+// Run a Go migration that was registered via AddMigration,
+// within a transaction of its own.
+func runRegisteredGoMigration(conf *DBConf, db *sql.DB, m *Migration, direction bool) error {
+
+	fn := m.DownFn
+	if direction {
+		fn = m.UpFn
+	}
+
+	// the metadata kept when the migration was applied is read
+	// before the transaction begins, which may hold the only
+	// connection to the DB
+	var metadata json.RawMessage
+	if !direction && m.DownMetadataFn != nil {
+		md, err := versionMetadata(conf, db, m.Version)
+		if err != nil {
+			return err
+		}
+		metadata = md
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := runHook("BeforeEach", conf.BeforeEach, txn, m.Version, direction); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	var kept json.RawMessage
+	start := time.Now()
+	switch {
+	case fn != nil:
+		err = fn(txn)
+	case direction && m.UpMetadataFn != nil:
+		kept, err = m.UpMetadataFn(txn)
+		if err == nil && len(kept) > 0 && !json.Valid(kept) {
+			err = fmt.Errorf("the metadata returned by %s isn't valid JSON", m.name())
+		}
+	case !direction && m.DownMetadataFn != nil:
+		err = m.DownMetadataFn(txn, metadata)
+	}
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	duration := time.Since(start)
+
+	if err := runHook("AfterEach", conf.AfterEach, txn, m.Version, direction); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	// the source of a migration compiled into another
+	// binary may not be around to checksum
+	checksum, err := fileChecksum(m.Source)
+	if err != nil && !os.IsNotExist(err) {
+		txn.Rollback()
+		return err
+	}
+
+	return FinalizeMigrationRecord(conf, txn, MigrationRecord{
+		VersionId: m.Version,
+		IsApplied: direction,
+		Checksum:  checksum,
+		Duration:  duration,
+		Metadata:  kept,
+	})
+}
+
+// the metadata recorded when version was last applied,
+// or nil if there's none, or it isn't applied
+func versionMetadata(conf *DBConf, db *sql.DB, version int64) (json.RawMessage, error) {
+
+	ms, ok := conf.Driver.Dialect.(metadataStore)
+	if !ok {
+		return nil, nil
+	}
+
+	rows, err := ms.VersionMetadataQuery(db, conf.quotedVersionTable(), version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	var isApplied bool
+	var metadata sql.NullString
+	if err := rows.Scan(&isApplied, &metadata); err != nil {
+		return nil, err
+	}
+	if !isApplied || !metadata.Valid || metadata.String == "" {
+		return nil, nil
+	}
+
+	return json.RawMessage(metadata.String), nil
+}
+
 //
 // template for the main entry point to a go-based migration.
 // this gets linked against the substituted versions of the user-supplied
@@ -121,7 +407,13 @@ package main
 import (
 	"log"
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	_ "{{.Import}}"
 	"github.com/superhuman/goose/lib/goose"
@@ -134,6 +426,14 @@ type SharedConf struct {
 	Env           string
 	MigrationsDir string
 	PgSchema      string
+	Dialect       string
+	Placeholders  string
+	VersionTable  string
+
+	MaxOpenConns    int
+	ConnMaxLifetime time.Duration
+	ConnectTimeout  time.Duration
+	SqlitePragmas   []string
 }
 
 func main() {
@@ -145,15 +445,31 @@ func main() {
 		log.Fatal("json.Decode - ", err)
 	}
 
+	dialect := goose.DialectByName(sharedConf.Dialect)
+	if dialect == nil {
+		log.Fatalf("unknown dialect %q", sharedConf.Dialect)
+	}
+	if sharedConf.Placeholders != "" {
+		var err error
+		if dialect, err = goose.WithPlaceholders(dialect, goose.PlaceholderStyle(sharedConf.Placeholders)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	conf := goose.DBConf{
 		MigrationsDir: sharedConf.MigrationsDir,
 		Env: sharedConf.Env,
 		PgSchema: sharedConf.PgSchema,
+		VersionTable: sharedConf.VersionTable,
+		MaxOpenConns: sharedConf.MaxOpenConns,
+		ConnMaxLifetime: sharedConf.ConnMaxLifetime,
+		ConnectTimeout: sharedConf.ConnectTimeout,
+		SqlitePragmas: sharedConf.SqlitePragmas,
 		Driver: goose.DBDriver{
 			Name: sharedConf.Name,
 			OpenStr: sharedConf.OpenStr,
 			Import: sharedConf.Import,
-			Dialect: goose.PostgresDialect{},
+			Dialect: dialect,
 		},
 	}
 
@@ -163,16 +479,95 @@ func main() {
 	}
 	defer db.Close()
 
-	txn, err := db.Begin()
-	if err != nil {
-		log.Fatal("db.Begin:", err)
+	record := goose.MigrationRecord{
+		VersionId: {{ .Version }},
+		IsApplied: {{ .Direction }},
+		Checksum: "{{ .Checksum }}",
 	}
 
-	{{ .Func }}(txn)
+	// migrations that accept the *sql.DB rather than a *sql.Tx
+	// opt out of running inside a transaction.
+	switch fn := interface{}({{ .Func }}).(type) {
+	case func(*sql.Tx):
+		txn, err := db.Begin()
+		if err != nil {
+			log.Fatal("db.Begin:", err)
+		}
+
+		start := time.Now()
+		fn(txn)
+		record.Duration = time.Since(start)
+
+		err = goose.FinalizeMigrationRecord(&conf, txn, record)
+		if err != nil {
+			log.Fatal("Commit() failed:", err)
+		}
 
-	err = goose.FinalizeMigration(&conf, txn, {{ .Direction }}, {{ .Version }})
+	case func(context.Context, *sql.Tx) error:
+		ctx, cancel := migrationContext()
+		defer cancel()
+
+		txn, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Fatal("db.Begin:", err)
+		}
+
+		// a cancelled migration is rolled back, and its version not recorded
+		start := time.Now()
+		err = fn(ctx, txn)
+		if err == nil {
+			err = ctx.Err()
+		}
+		record.Duration = time.Since(start)
+		if err != nil {
+			txn.Rollback()
+			log.Fatal("{{ .Func }} failed:", err)
+		}
+
+		err = goose.FinalizeMigrationRecord(&conf, txn, record)
+		if err != nil {
+			log.Fatal("Commit() failed:", err)
+		}
+
+	case func(*sql.DB):
+		start := time.Now()
+		fn(db)
+		record.Duration = time.Since(start)
+
+		txn, err := db.Begin()
+		if err != nil {
+			log.Fatal("db.Begin:", err)
+		}
+
+		err = goose.FinalizeMigrationRecord(&conf, txn, record)
+		if err != nil {
+			log.Fatal("Commit() failed:", err)
+		}
+
+	default:
+		log.Fatalf("{{ .Func }} has unsupported signature %T", fn)
+	}
+}
+
+// the context passed to migrations is cancelled on interrupt,
+// or once GOOSE_TIMEOUT has elapsed if it's set.
+func migrationContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	s := os.Getenv("GOOSE_TIMEOUT")
+	if s == "" {
+		return ctx, stop
+	}
+
+	timeout, err := time.ParseDuration(s)
 	if err != nil {
-		log.Fatal("Commit() failed:", err)
+		log.Fatal("GOOSE_TIMEOUT:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
 	}
 }
 `))
@@ -0,0 +1,11 @@
+//go:build !((linux || darwin || freebsd) && cgo)
+
+package goose
+
+import "database/sql"
+
+// plugins are only supported on some platforms, and only with cgo,
+// so Go migrations are always run via `go run` elsewhere
+func pluginGoMigration(path string, version int64, direction bool) (func(*sql.Tx) error, error) {
+	return nil, errPluginsUnsupported
+}
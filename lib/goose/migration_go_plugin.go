@@ -0,0 +1,38 @@
+//go:build (linux || darwin || freebsd) && cgo
+
+package goose
+
+import (
+	"database/sql"
+	"fmt"
+	"plugin"
+)
+
+// the function that a migrations plugin exports, returning the Up
+// (if up is true) or Down function for a version, or nil if the
+// plugin doesn't provide that migration
+type pluginMigrationFunc = func(version int64, up bool) func(*sql.Tx) error
+
+// Look up the Go migration for version in the plugin at path, which
+// must export GooseMigration as a pluginMigrationFunc. Returns a nil
+// func if the plugin doesn't provide it, in which case the migration
+// is run via `go run` as usual.
+func pluginGoMigration(path string, version int64, direction bool) (func(*sql.Tx) error, error) {
+
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening Go migrations plugin: %w", err)
+	}
+
+	sym, err := p.Lookup("GooseMigration")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	lookup, ok := sym.(pluginMigrationFunc)
+	if !ok {
+		return nil, fmt.Errorf("%s: GooseMigration has unsupported signature %T", path, sym)
+	}
+
+	return lookup(version, direction), nil
+}
@@ -3,33 +3,319 @@ package goose
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"os"
-	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 const sqlCmdPrefix = "-- +goose "
 
+// the byte order mark that some Windows editors begin files with
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// strip any leading byte order mark, and convert CRLF line endings
+// to LF, so that the annotations of scripts saved on Windows, and
+// the statements split from them, are the same as anywhere else
+func normalizeSQL(src []byte) []byte {
+	src = bytes.TrimPrefix(src, utf8BOM)
+	return bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+}
+
+// begins each migration within a combined file of SQL migrations
+const sqlVersionPrefix = sqlCmdPrefix + "Version:"
+
+// one migration within a combined file
+type combinedSection struct {
+	version int64
+	src     []byte // everything after its Version marker, up to the next
+}
+
+// split a combined file of SQL migrations, each beginning with a
+// '-- +goose Version: NNN' line and having Up and Down sections as
+// usual, into its migrations in the order they appear. Only blank
+// lines and comments may precede the first of them.
+func splitCombinedMigrations(src []byte) ([]combinedSection, error) {
+
+	var sections []combinedSection
+
+	scanner := bufio.NewScanner(bytes.NewReader(normalizeSQL(src)))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, sqlVersionPrefix) {
+			s := strings.TrimSpace(line[len(sqlVersionPrefix):])
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || v <= 0 {
+				return nil, fmt.Errorf("line %d: invalid version %q", n, s)
+			}
+			sections = append(sections, combinedSection{version: v, src: []byte{}})
+			continue
+		}
+
+		if len(sections) == 0 {
+			if t := strings.TrimSpace(line); t != "" && !strings.HasPrefix(t, "--") {
+				return nil, fmt.Errorf("line %d: SQL before the first '%s' line", n, sqlVersionPrefix)
+			}
+			continue
+		}
+
+		last := &sections[len(sections)-1]
+		last.src = append(last.src, line+"\n"...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanning migrations: %w", err)
+	}
+
+	if len(sections) == 0 {
+		return nil, fmt.Errorf("no '%s' lines found", sqlVersionPrefix)
+	}
+
+	return sections, nil
+}
+
 // Checks the line to see if the line has a statement-ending semicolon
 // or if the line contains a double-dash comment.
 func endsWithSemicolon(line string) bool {
+	var s sqlScanner
+	return s.scanLine(line)
+}
 
-	prev := ""
-	scanner := bufio.NewScanner(strings.NewReader(line))
-	scanner.Split(bufio.ScanWords)
+// sqlScanner tracks the state of a statement that can span lines,
+// so that semicolons within quoted text or comments don't end the statement.
+type sqlScanner struct {
+	quote        byte   // the quote character of an open string or quoted identifier
+	dollarTag    string // the closing tag of an open dollar-quoted string, e.g. $$ or $func$
+	commentDepth int    // nesting depth of open /* */ block comments
+}
 
-	for scanner.Scan() {
-		word := scanner.Text()
-		if strings.HasPrefix(word, "--") {
-			break
+// scanLine consumes the next line of a statement, and reports
+// whether the line ends with a statement-ending semicolon.
+func (s *sqlScanner) scanLine(line string) bool {
+
+	var last byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case s.quote != 0:
+			if c == s.quote {
+				// a doubled quote is an escaped quote, not the end of the string
+				if i+1 < len(line) && line[i+1] == s.quote {
+					i++
+					continue
+				}
+				s.quote = 0
+				last = c
+			}
+			continue
+
+		case s.dollarTag != "":
+			if strings.HasPrefix(line[i:], s.dollarTag) {
+				i += len(s.dollarTag) - 1
+				s.dollarTag = ""
+				last = '$'
+			}
+			continue
+
+		case s.commentDepth > 0:
+			if strings.HasPrefix(line[i:], "/*") {
+				s.commentDepth++
+				i++
+			} else if strings.HasPrefix(line[i:], "*/") {
+				s.commentDepth--
+				i++
+			}
+			continue
+
+		case strings.HasPrefix(line[i:], "/*"):
+			s.commentDepth = 1
+			i++
+			continue
+
+		case strings.HasPrefix(line[i:], "--"):
+			// the remainder of the line is a comment
+			return s.commentDepth == 0 && last == ';'
+
+		case c == '\'' || c == '"':
+			s.quote = c
+
+		case c == '$':
+			if tag := dollarQuoteTag(line, i); tag != "" {
+				s.dollarTag = tag
+				i += len(tag) - 1
+			}
+		}
+
+		if !isSpace(c) {
+			last = c
+		}
+	}
+
+	return s.quote == 0 && s.dollarTag == "" && s.commentDepth == 0 && last == ';'
+}
+
+// dollarQuoteTag returns the dollar quote tag, e.g. $$ or $func$,
+// that opens at line[i], or "" if there isn't one.
+// positional parameters like $1 are not tags.
+func dollarQuoteTag(line string, i int) string {
+
+	if i > 0 && isIdentChar(line[i-1]) {
+		return ""
+	}
+
+	for j := i + 1; j < len(line); j++ {
+		c := line[j]
+		switch {
+		case c == '$':
+			return line[i : j+1]
+		case j == i+1 && c >= '0' && c <= '9':
+			return ""
+		case !isIdentChar(c):
+			return ""
+		}
+	}
+
+	return ""
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isIdentStart(c byte) bool {
+	return isIdentChar(c) && !(c >= '0' && c <= '9')
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// Expand ${VAR} and $VAR references in the script, looking them up
+// in conf.EnvVars if it's set, or in the process environment otherwise.
+// Unset variables expand to "", or are an error if conf.StrictEnv is set.
+//
+// $$ and $tag$ dollar-quote delimiters and $1 style parameters are
+// left as they are, as is a bare $VAR that directly follows an
+// identifier, since postgres allows $ within identifiers.
+func expandSQLEnv(conf *DBConf, src string) (string, error) {
+
+	lookup := envLookup(conf)
+
+	var buf strings.Builder
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if c != '$' {
+			buf.WriteByte(c)
+			continue
+		}
+
+		if tag := dollarQuoteTag(src, i); tag != "" {
+			buf.WriteString(tag)
+			i += len(tag) - 1
+			continue
+		}
+
+		var name, ref string
+		switch {
+		case i+1 < len(src) && src[i+1] == '{':
+			end := strings.IndexByte(src[i+2:], '}')
+			if end < 0 {
+				buf.WriteByte(c)
+				continue
+			}
+			name = src[i+2 : i+2+end]
+			ref = src[i : i+3+end]
+
+		case i+1 < len(src) && isIdentStart(src[i+1]) && !(i > 0 && isIdentChar(src[i-1])):
+			j := i + 1
+			for j < len(src) && isIdentChar(src[j]) {
+				j++
+			}
+			name = src[i+1 : j]
+			ref = src[i:j]
+
+		default:
+			buf.WriteByte(c)
+			continue
+		}
+
+		v, ok := lookup(name)
+		if !ok && conf.StrictEnv {
+			return "", fmt.Errorf("%s is not set", name)
+		}
+		buf.WriteString(v)
+		i += len(ref) - 1
+	}
+
+	return buf.String(), nil
+}
+
+// looks up variables in conf.EnvVars if it's set,
+// or in the process environment otherwise
+func envLookup(conf *DBConf) func(name string) (string, bool) {
+	if conf.EnvVars == nil {
+		return os.LookupEnv
+	}
+	return func(name string) (string, bool) {
+		v, ok := conf.EnvVars[name]
+		return v, ok
+	}
+}
+
+// the script's source, executed as a template if it's annotated
+// TEMPLATE, with any variables expanded if conf asks for it
+func sqlSource(conf *DBConf, src []byte) (io.Reader, error) {
+
+	src = normalizeSQL(src)
+
+	templated, err := sqlHasAnnotation(src, "TEMPLATE")
+	if err != nil {
+		return nil, err
+	}
+	if templated {
+		if src, err = executeSQLTemplate(conf, src); err != nil {
+			return nil, err
 		}
-		prev = word
 	}
 
-	return strings.HasSuffix(prev, ";")
+	if !conf.ExpandEnv {
+		return bytes.NewReader(src), nil
+	}
+
+	expanded, err := expandSQLEnv(conf, string(src))
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(expanded), nil
+}
+
+// execute a script annotated TEMPLATE as a text/template with
+// conf.TemplateData, e.g. to create a table for each of a list of
+// tenants. it's executed before any variables are expanded, so
+// that those don't clash with the template's own $variables.
+func executeSQLTemplate(conf *DBConf, src []byte) ([]byte, error) {
+
+	tmpl, err := template.New("migration").Option("missingkey=error").Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, conf.TemplateData); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
 
 // Split the given sql script into individual statements.
@@ -38,10 +324,23 @@ func endsWithSemicolon(line string) bool {
 // naturally terminate a statement.
 //
 // However, more complex cases like pl/pgsql can have semicolons
-// within a statement. For these cases, we provide the explicit annotations
+// within a statement. Semicolons within quoted strings and identifiers,
+// including dollar-quoted strings, and within -- and /* */ comments
+// are ignored, and for other cases we provide the explicit annotations
 // 'StatementBegin' and 'StatementEnd' to allow the script to
 // tell us to ignore semicolons.
-func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
+//
+// Scripts annotated with 'NO TRANSACTION' report useTx as false,
+// for statements that can't be run inside a transaction block.
+func splitSQLStatements(r io.Reader, direction bool) (stmts []string, useTx bool, err error) {
+	if direction {
+		return splitSQLSection(r, "Up")
+	}
+	return splitSQLSection(r, "Down")
+}
+
+// split the statements of the given section: Up, Down or Verify
+func splitSQLSection(r io.Reader, section string) (stmts []string, useTx bool, err error) {
 
 	var buf bytes.Buffer
 	scanner := bufio.NewScanner(r)
@@ -54,6 +353,9 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 	statementEnded := false
 	ignoreSemicolons := false
 	directionIsActive := false
+	useTx = true
+
+	var sqlScan sqlScanner
 
 	for scanner.Scan() {
 
@@ -64,13 +366,20 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 			cmd := strings.TrimSpace(line[len(sqlCmdPrefix):])
 			switch cmd {
 			case "Up":
-				directionIsActive = (direction == true)
+				directionIsActive = (section == "Up")
 				upSections++
+				sqlScan = sqlScanner{}
 				break
 
 			case "Down":
-				directionIsActive = (direction == false)
+				directionIsActive = (section == "Down")
 				downSections++
+				sqlScan = sqlScanner{}
+				break
+
+			case "Verify":
+				directionIsActive = (section == "Verify")
+				sqlScan = sqlScanner{}
 				break
 
 			case "StatementBegin":
@@ -85,6 +394,10 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 					ignoreSemicolons = false
 				}
 				break
+
+			case "NO TRANSACTION":
+				useTx = false
+				break
 			}
 		}
 
@@ -92,41 +405,296 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 			continue
 		}
 
-		if _, err := buf.WriteString(line + "\n"); err != nil {
-			log.Fatalf("io err: %v", err)
-		}
+		buf.WriteString(line + "\n")
 
 		// Wrap up the two supported cases: 1) basic with semicolon; 2) psql statement
 		// Lines that end with semicolon that are in a statement block
 		// do not conclude statement.
-		if (!ignoreSemicolons && endsWithSemicolon(line)) || statementEnded {
+		endsStatement := sqlScan.scanLine(line)
+		if (!ignoreSemicolons && endsStatement) || statementEnded {
 			statementEnded = false
+			sqlScan = sqlScanner{}
 			stmts = append(stmts, buf.String())
 			buf.Reset()
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatalf("scanning migration: %v", err)
+		return nil, false, fmt.Errorf("scanning migration: %w", err)
 	}
 
 	// diagnose likely migration script errors
 	if ignoreSemicolons {
-		log.Println("WARNING: saw '-- +goose StatementBegin' with no matching '-- +goose StatementEnd'")
+		return nil, false, errors.New("saw '-- +goose StatementBegin' with no matching '-- +goose StatementEnd'")
 	}
 
 	if bufferRemaining := strings.TrimSpace(buf.String()); len(bufferRemaining) > 0 {
-		log.Printf("WARNING: Unexpected unfinished SQL query: %s. Missing a semicolon?\n", bufferRemaining)
+		logger.Printf("WARNING: Unexpected unfinished SQL query: %s. Missing a semicolon?\n", bufferRemaining)
 	}
 
 	if upSections == 0 && downSections == 0 {
-		log.Fatalf(`ERROR: no Up/Down annotations found, so no statements were executed.
+		return nil, false, errors.New(`no Up/Down annotations found, so no statements were executed.
 			See https://bitbucket.org/liamstask/goose/overview for details.`)
 	}
 
 	return
 }
 
+// does the script have the given annotation, e.g. a Down section?
+func sqlHasAnnotation(src []byte, annotation string) (bool, error) {
+
+	scanner := bufio.NewScanner(bytes.NewReader(normalizeSQL(src)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, sqlCmdPrefix) && strings.TrimSpace(line[len(sqlCmdPrefix):]) == annotation {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// the duration of the script's TIMEOUT annotation,
+// e.g. '-- +goose TIMEOUT 30s', or 0 if it has none
+func sqlTimeout(src []byte) (time.Duration, error) {
+
+	scanner := bufio.NewScanner(bytes.NewReader(normalizeSQL(src)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, sqlCmdPrefix) {
+			continue
+		}
+
+		fields := strings.Fields(line[len(sqlCmdPrefix):])
+		if len(fields) == 0 || fields[0] != "TIMEOUT" {
+			continue
+		}
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("'%s' should be followed by a duration, e.g. 30s", strings.TrimSpace(line))
+		}
+
+		timeout, err := time.ParseDuration(fields[1])
+		if err != nil || timeout <= 0 {
+			return 0, fmt.Errorf("invalid TIMEOUT %q, expected a positive duration, e.g. 30s", fields[1])
+		}
+		return timeout, nil
+	}
+
+	return 0, scanner.Err()
+}
+
+// a comparison of a variable with a value in an ONLY IF
+// expression, e.g. TIER = enterprise or REGION != 'eu'
+var conditionRegexp = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*(==|=|!=)\s*(.*)$`)
+
+// does the script's ONLY IF annotation hold, e.g.
+// '-- +goose ONLY IF TIER = enterprise AND REGION != eu'?
+// its comparisons are of variables, looked up as they are for
+// ExpandEnv, with values, which may be quoted, and must all hold.
+// scripts without the annotation always hold, and expr is "".
+func sqlCondition(conf *DBConf, src []byte) (holds bool, expr string, err error) {
+
+	scanner := bufio.NewScanner(bytes.NewReader(normalizeSQL(src)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, sqlCmdPrefix) {
+			continue
+		}
+
+		fields := strings.Fields(line[len(sqlCmdPrefix):])
+		if len(fields) < 2 || fields[0] != "ONLY" || fields[1] != "IF" {
+			continue
+		}
+
+		expr = strings.Join(fields[2:], " ")
+		holds, err = evalCondition(conf, expr)
+		return holds, expr, err
+	}
+
+	return true, "", scanner.Err()
+}
+
+func evalCondition(conf *DBConf, expr string) (bool, error) {
+
+	if expr == "" {
+		return false, errors.New("'-- +goose ONLY IF' should be followed by a condition, e.g. TIER = enterprise")
+	}
+
+	lookup := envLookup(conf)
+	holds := true
+	for _, clause := range strings.Split(expr, " AND ") {
+		match := conditionRegexp.FindStringSubmatch(strings.TrimSpace(clause))
+		if match == nil || match[3] == "" {
+			return false, fmt.Errorf("invalid ONLY IF condition %q, expected e.g. TIER = enterprise", clause)
+		}
+		name, op, want := match[1], match[2], unquoteValue(match[3])
+
+		v, ok := lookup(name)
+		if !ok && conf.StrictEnv {
+			return false, fmt.Errorf("%s is not set", name)
+		}
+		if (v == want) == (op == "!=") {
+			holds = false
+		}
+	}
+
+	return holds, nil
+}
+
+// strip the quotes from a value quoted with ' or "
+func unquoteValue(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// say so if err is due to the migration overrunning its TIMEOUT
+func timeoutError(ctx context.Context, timeout time.Duration, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("exceeded its TIMEOUT of %v: %w", timeout, err)
+	}
+	return err
+}
+
+// how much of a failed statement its error quotes
+const statementErrorLength = 80
+
+// satisfied by both *sql.DB and *sql.Tx
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// run a statement of migration v's Verify section, given its index.
+// it holds if it returns no rows, or a first row whose first column
+// is true or zero, e.g. a count of the rows a backfill missed.
+func verifyStatement(ctx context.Context, q rowQueryer, v int64, i int, stmt string) error {
+
+	var val interface{}
+	err := q.QueryRowContext(ctx, stmt).Scan(&val)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d verification #%d failed: %s: %w", v, i+1, statementPrefix(stmt, statementErrorLength), err)
+	}
+
+	if b, ok := val.([]byte); ok {
+		val = string(b)
+	}
+	if !verifiedValue(val) {
+		return fmt.Errorf("migration %d verification #%d failed: %s: got %v", v, i+1, statementPrefix(stmt, statementErrorLength), val)
+	}
+
+	return nil
+}
+
+// is a value returned by a Verify statement true or zero?
+// drivers that return text, e.g. mysql's, give "0" for zero.
+func verifiedValue(val interface{}) bool {
+	switch t := val.(type) {
+	case bool:
+		return t
+	case int64:
+		return t == 0
+	case float64:
+		return t == 0
+	case string:
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return f == 0
+		}
+		b, err := strconv.ParseBool(t)
+		return err == nil && b
+	}
+	return false
+}
+
+// say which statement of migration v failed, given its index
+func statementError(v int64, i int, stmt string, err error) error {
+	return fmt.Errorf("migration %d statement #%d failed: %s: %w", v, i+1, statementPrefix(stmt, statementErrorLength), err)
+}
+
+// the start of the statement, after any comment lines leading
+// up to it, with its whitespace collapsed, cut to n characters
+func statementPrefix(stmt string, n int) string {
+
+	var lines []string
+	for _, line := range strings.Split(stmt, "\n") {
+		line = strings.TrimSpace(line)
+		if len(lines) == 0 && (line == "" || strings.HasPrefix(line, "--")) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	s := []rune(strings.Join(strings.Fields(strings.Join(lines, " ")), " "))
+	if len(s) > n {
+		return string(s[:n]) + "..."
+	}
+	return string(s)
+}
+
+// explain what a failed statement has left behind, under a dialect
+// that commits DDL implicitly: rolling back the transaction doesn't
+// undo the statements before the last DDL statement that ran, and
+// an "already exists" error may be due to an earlier partial run.
+func partlyAppliedError(ran []string, failed string, err error) error {
+
+	committed := 0
+	for i, stmt := range ran {
+		if isDDL(stmt) {
+			committed = i + 1
+		}
+	}
+
+	if committed > 0 {
+		return fmt.Errorf("%w\nthe %d statement(s) up to and including the last DDL before it were committed implicitly, "+
+			"and aren't undone by the rollback; the version wasn't recorded, so reconcile the schema by hand before re-running", err, committed)
+	}
+
+	if isDDL(failed) && isAlreadyExistsError(err) {
+		return fmt.Errorf("%w\nDDL is committed implicitly, so this may have been left by an earlier run of the migration that failed part way; "+
+			"reconcile the schema by hand before re-running", err)
+	}
+
+	return err
+}
+
+// is any of the statements DDL?
+func anyDDL(stmts []string) bool {
+	for _, stmt := range stmts {
+		if isDDL(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// the statements that implicitly commit under mysql
+var ddlKeywords = map[string]bool{"CREATE": true, "ALTER": true, "DROP": true, "RENAME": true, "TRUNCATE": true}
+
+// is the statement DDL, judging by its first keyword
+// after any leading comments?
+func isDDL(stmt string) bool {
+	for _, line := range strings.Split(stmt, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		word := strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == ';' || r == '(' })
+		return len(word) > 0 && ddlKeywords[strings.ToUpper(word[0])]
+	}
+	return false
+}
+
+// does err report a table, column or index that already exists,
+// e.g. mysql's 1050, 1060 and 1061 errors?
+func isAlreadyExistsError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "already exists") || strings.Contains(msg, "duplicate column") ||
+		strings.Contains(msg, "duplicate key name")
+}
+
 // Run a migration specified in raw SQL.
 //
 // Sections of the script can be annotated with a special comment,
@@ -135,16 +703,189 @@ func splitSQLStatements(r io.Reader, direction bool) (stmts []string) {
 //
 // All statements following an Up or Down directive are grouped together
 // until another direction directive is found.
-func runSQLMigration(conf *DBConf, db *sql.DB, scriptFile string, v int64, direction bool) error {
+//
+// Scripts annotated with 'NO TRANSACTION' have their statements
+// executed directly against the DB, and the version is recorded
+// in a transaction of its own once they have all succeeded.
+//
+// When migrating up, the statements of an optional Verify section
+// are run after those of the Up section, and the migration fails,
+// and is rolled back if it can be, unless each of them holds.
+//
+// Scripts annotated with a TIMEOUT have their statements cancelled,
+// and the migration rolled back, once it's up. Drivers that can't
+// cancel a statement part way fail the next one instead.
+func runSQLMigration(conf *DBConf, db *sql.DB, m *Migration, direction bool) error {
+
+	name, v := m.name(), m.Version
+
+	src, err := readMigration(conf, m)
+	if err != nil {
+		return err
+	}
+
+	r, err := sqlSource(conf, src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
 
-	txn, err := db.Begin()
+	stmts, useTx, err := splitSQLStatements(r, direction)
 	if err != nil {
-		log.Fatal("db.Begin:", err)
+		return fmt.Errorf("%s: %w", name, err)
 	}
+	rec := MigrationRecord{VersionId: v, IsApplied: direction, Checksum: bytesChecksum(src)}
 
-	f, err := os.Open(scriptFile)
+	timeout, err := sqlTimeout(src)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var verify []string
+	if direction {
+		r, err := sqlSource(conf, src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if verify, _, err = splitSQLSection(r, "Verify"); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	stmts, verify = trimStatements(conf.Driver.Dialect, stmts), trimStatements(conf.Driver.Dialect, verify)
+
+	if !runInTransaction(conf, useTx) {
+		start := time.Now()
+		for i, query := range stmts {
+			logStatement(conf, v, direction, query)
+			for attempt := 0; ; attempt++ {
+				_, err = db.ExecContext(ctx, query)
+				delay, retry := retryDelay(conf, attempt, err)
+				if !retry {
+					break
+				}
+				logger.Printf("WARNING: %s: %v, retrying in %v\n", name, statementError(v, i, query, err), delay)
+				time.Sleep(delay)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, statementError(v, i, query, timeoutError(ctx, timeout, err)))
+			}
+		}
+		for i, query := range verify {
+			logStatement(conf, v, direction, query)
+			if err = verifyStatement(ctx, db, v, i, query); err != nil {
+				return fmt.Errorf("%s: %w", name, timeoutError(ctx, timeout, err))
+			}
+		}
+		rec.Duration = time.Since(start)
+
+		txn, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("db.Begin: %w", err)
+		}
+
+		if err = FinalizeMigrationRecord(conf, txn, rec); err != nil {
+			return fmt.Errorf("error finalizing migration %s: %w", name, err)
+		}
+
+		return nil
+	}
+
+	// a transaction that fails with an error worth retrying is retried
+	// from the start, unless DDL has already been committed implicitly
+	for attempt := 0; ; attempt++ {
+		ranDDL, err := runSQLTransaction(ctx, conf, db, m, direction, stmts, verify, rec, timeout)
+		delay, retry := retryDelay(conf, attempt, err)
+		if ranDDL || !retry {
+			return err
+		}
+		logger.Printf("WARNING: %v, retrying in %v\n", err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// run the Up statements of a SQL migration without recording it,
+// for DBConf.NoVersioning
+func runUnversionedSQL(conf *DBConf, db *sql.DB, m *Migration) error {
+
+	src, err := readMigration(conf, m)
+	if err != nil {
+		return err
+	}
+
+	holds, expr, err := sqlCondition(conf, src)
+	if err != nil {
+		return err
+	}
+	if !holds {
+		logger.Printf("goose: skipping %s, since ONLY IF %s doesn't hold\n", m.name(), expr)
+		return nil
+	}
+
+	r, err := sqlSource(conf, src)
+	if err != nil {
+		return err
+	}
+	stmts, useTx, err := splitSQLStatements(r, true)
+	if err != nil {
+		return err
+	}
+	stmts = trimStatements(conf.Driver.Dialect, stmts)
+
+	if conf.DryRun {
+		fmt.Printf("\n-- goose dry run: run %s\n", m.name())
+		for _, stmt := range stmts {
+			fmt.Print(stmt)
+		}
+		return nil
+	}
+
+	type execer interface {
+		Exec(query string, args ...interface{}) (sql.Result, error)
+	}
+	var ex execer = db
+
+	var txn *sql.Tx
+	if runInTransaction(conf, useTx) {
+		if txn, err = db.Begin(); err != nil {
+			return fmt.Errorf("db.Begin: %w", err)
+		}
+		ex = txn
+	}
+
+	for i, query := range stmts {
+		logStatement(conf, m.Version, true, query)
+		if _, err = ex.Exec(query); err != nil {
+			if txn != nil {
+				txn.Rollback()
+			}
+			return statementError(m.Version, i, query, err)
+		}
+	}
+
+	if txn != nil {
+		return txn.Commit()
+	}
+	return nil
+}
+
+// run the statements of a SQL migration, and record it, in a transaction.
+// ranDDL reports whether a DDL statement had been run, under a dialect
+// that commits DDL implicitly, so that rolling back didn't undo it all.
+func runSQLTransaction(ctx context.Context, conf *DBConf, db *sql.DB, m *Migration, direction bool,
+	stmts, verify []string, rec MigrationRecord, timeout time.Duration) (ranDDL bool, err error) {
+
+	name, v := m.name(), m.Version
+	committer := commitsDDL(conf.Driver.Dialect)
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("db.Begin: %w", err)
 	}
 
 	// find each statement, checking annotations for up/down direction
@@ -152,17 +893,186 @@ func runSQLMigration(conf *DBConf, db *sql.DB, scriptFile string, v int64, direc
 	// Commits the transaction if successfully applied each statement and
 	// records the version into the version table or returns an error and
 	// rolls back the transaction.
-	for _, query := range splitSQLStatements(f, direction) {
-		if _, err = txn.Exec(query); err != nil {
+	if err = runHook("BeforeEach", conf.BeforeEach, txn, v, direction); err != nil {
+		txn.Rollback()
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+
+	start := time.Now()
+	for i, query := range stmts {
+		logStatement(conf, v, direction, query)
+		if _, err = txn.ExecContext(ctx, query); err != nil {
 			txn.Rollback()
-			log.Fatalf("FAIL %s (%v), quitting migration.", filepath.Base(scriptFile), err)
-			return err
+			err = timeoutError(ctx, timeout, err)
+			if committer {
+				err = partlyAppliedError(stmts[:i], query, err)
+			}
+			return committer && anyDDL(stmts[:i]), fmt.Errorf("%s: %w", name, statementError(v, i, query, err))
 		}
 	}
+	ranDDL = committer && anyDDL(stmts)
+
+	for i, query := range verify {
+		logStatement(conf, v, direction, query)
+		if err = verifyStatement(ctx, txn, v, i, query); err != nil {
+			txn.Rollback()
+			return ranDDL, fmt.Errorf("%s: %w", name, timeoutError(ctx, timeout, err))
+		}
+	}
+	rec.Duration = time.Since(start)
+
+	if err = runHook("AfterEach", conf.AfterEach, txn, v, direction); err != nil {
+		txn.Rollback()
+		return ranDDL, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if err = FinalizeMigrationRecord(conf, txn, rec); err != nil {
+		return ranDDL, fmt.Errorf("error finalizing migration %s: %w", name, timeoutError(ctx, timeout, err))
+	}
+
+	return ranDDL, nil
+}
+
+// a SQL migration read and split ahead of running it in a batch,
+// for DBConf.Batch
+type batchMigration struct {
+	m       *Migration
+	stmts   []string
+	verify  []string
+	rec     MigrationRecord
+	timeout time.Duration
+
+	// its ONLY IF condition doesn't hold, so it's only recorded
+	skip bool
+}
 
-	if err = FinalizeMigration(conf, txn, direction, v); err != nil {
-		log.Fatalf("error finalizing migration %s, quitting. (%v)", filepath.Base(scriptFile), err)
+// read and split a SQL migration to be run in a batch, which can
+// only be done if its statements may be run in a transaction
+func prepareBatchSQL(conf *DBConf, m *Migration, direction bool) (*batchMigration, error) {
+
+	name := m.name()
+	if migrationExt(m.Source) != ".sql" {
+		return nil, fmt.Errorf("%s: Go migrations can't be run in a batch", name)
+	}
+
+	if !direction {
+		irreversible, err := isIrreversible(conf, m)
+		if err != nil {
+			return nil, err
+		}
+		if irreversible {
+			return nil, fmt.Errorf("migration %d is irreversible", m.Version)
+		}
 	}
 
+	src, err := readMigration(conf, m)
+	if err != nil {
+		return nil, err
+	}
+	bm := &batchMigration{m: m, rec: MigrationRecord{VersionId: m.Version, IsApplied: direction, Checksum: bytesChecksum(src)}}
+
+	holds, _, err := sqlCondition(conf, src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if !holds {
+		bm.skip = true
+		return bm, nil
+	}
+
+	r, err := sqlSource(conf, src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	stmts, useTx, err := splitSQLStatements(r, direction)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if !runInTransaction(conf, useTx) {
+		return nil, fmt.Errorf("%s: migrations run outside a transaction can't be run in a batch", name)
+	}
+
+	if bm.timeout, err = sqlTimeout(src); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	var verify []string
+	if direction {
+		r, err := sqlSource(conf, src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if verify, _, err = splitSQLSection(r, "Verify"); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	bm.stmts, bm.verify = trimStatements(conf.Driver.Dialect, stmts), trimStatements(conf.Driver.Dialect, verify)
+	return bm, nil
+}
+
+// run the statements of a batch's SQL migration, and record it, in
+// the batch's transaction. it's left to the caller to roll back to
+// the migration's savepoint if it fails.
+func runBatchSQL(conf *DBConf, txn *sql.Tx, bm *batchMigration, direction bool) error {
+
+	name, v := bm.m.name(), bm.m.Version
+
+	if bm.skip {
+		logger.Printf("goose: skipping the body of %s, since its ONLY IF condition doesn't hold\n", name)
+		return RecordMigration(conf, txn, bm.rec)
+	}
+
+	ctx := context.Background()
+	if bm.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bm.timeout)
+		defer cancel()
+	}
+
+	if err := runHook("BeforeEach", conf.BeforeEach, txn, v, direction); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	start := time.Now()
+	for i, query := range bm.stmts {
+		logStatement(conf, v, direction, query)
+		if _, err := txn.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("%s: %w", name, statementError(v, i, query, timeoutError(ctx, bm.timeout, err)))
+		}
+	}
+	for i, query := range bm.verify {
+		logStatement(conf, v, direction, query)
+		if err := verifyStatement(ctx, txn, v, i, query); err != nil {
+			return fmt.Errorf("%s: %w", name, timeoutError(ctx, bm.timeout, err))
+		}
+	}
+	bm.rec.Duration = time.Since(start)
+
+	if err := runHook("AfterEach", conf.AfterEach, txn, v, direction); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	if err := RecordMigration(conf, txn, bm.rec); err != nil {
+		return fmt.Errorf("error recording migration %s: %w", name, err)
+	}
 	return nil
 }
+
+// the wait before the first retry, unless DBConf.RetryBackoff says otherwise
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// how long to wait before retrying something that failed with err,
+// on the given attempt counting from 0, and whether to retry it at all
+func retryDelay(conf *DBConf, attempt int, err error) (time.Duration, bool) {
+
+	if err == nil || attempt >= conf.Retries || !isRetryable(conf.Driver.Dialect, err) {
+		return 0, false
+	}
+
+	delay := conf.RetryBackoff
+	if delay <= 0 {
+		delay = defaultRetryBackoff
+	}
+	return delay << attempt, true
+}
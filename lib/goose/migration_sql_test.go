@@ -1,8 +1,13 @@
 package goose
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSemicolons(t *testing.T) {
@@ -37,6 +42,38 @@ func TestSemicolons(t *testing.T) {
 			line:   "END \" ; \" -- comment",
 			result: false,
 		},
+		{
+			line:   "SELECT 'a;' ;",
+			result: true,
+		},
+		{
+			line:   "SELECT 'a;",
+			result: false,
+		},
+		{
+			line:   "SELECT 'it''s;' -- it's a comment",
+			result: false,
+		},
+		{
+			line:   "SELECT \"a\"\";\";",
+			result: true,
+		},
+		{
+			line:   "SELECT 1 /* ; */",
+			result: false,
+		},
+		{
+			line:   "SELECT 1; /* done */",
+			result: true,
+		},
+		{
+			line:   "SELECT 1; /* /* nested */ still open",
+			result: false,
+		},
+		{
+			line:   "SELECT 1 /* '; */ ;",
+			result: true,
+		},
 	}
 
 	for _, test := range tests {
@@ -76,16 +113,463 @@ func TestSplitStatements(t *testing.T) {
 			direction: false,
 			count:     2,
 		},
+		{
+			sql:       dollartxt,
+			direction: true,
+			count:     3,
+		},
+		{
+			sql:       dollartxt,
+			direction: false,
+			count:     2,
+		},
+		{
+			sql:       quotetxt,
+			direction: true,
+			count:     4,
+		},
+		{
+			sql:       quotetxt,
+			direction: false,
+			count:     1,
+		},
+		{
+			sql:       commenttxt,
+			direction: true,
+			count:     3,
+		},
+		{
+			sql:       commenttxt,
+			direction: false,
+			count:     1,
+		},
 	}
 
 	for _, test := range tests {
-		stmts := splitSQLStatements(strings.NewReader(test.sql), test.direction)
+		stmts, _, err := splitSQLStatements(strings.NewReader(test.sql), test.direction)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if len(stmts) != test.count {
 			t.Errorf("incorrect number of stmts. got %v, want %v", len(stmts), test.count)
 		}
 	}
 }
 
+func TestNoTransaction(t *testing.T) {
+
+	tests := []struct {
+		sql   string
+		useTx bool
+	}{
+		{sql: functxt, useTx: true},
+		{sql: notxtxt, useTx: false},
+	}
+
+	for _, test := range tests {
+		_, useTx, err := splitSQLStatements(strings.NewReader(test.sql), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if useTx != test.useTx {
+			t.Errorf("incorrect useTx. got %v, want %v", useTx, test.useTx)
+		}
+	}
+}
+
+func TestRunInTransaction(t *testing.T) {
+
+	tests := []struct {
+		conf  *DBConf
+		useTx bool
+		want  bool
+	}{
+		{&DBConf{Driver: DBDriver{Dialect: &PostgresDialect{}}}, true, true},
+		{&DBConf{Driver: DBDriver{Dialect: &PostgresDialect{}}}, false, false},
+		{&DBConf{Driver: DBDriver{Dialect: &PostgresDialect{}}, NoTransactions: true}, true, false},
+		{&DBConf{Driver: DBDriver{Dialect: &ClickHouseDialect{}}}, true, false},
+	}
+
+	for i, test := range tests {
+		if got := runInTransaction(test.conf, test.useTx); got != test.want {
+			t.Errorf("%d: runInTransaction = %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestNoAnnotations(t *testing.T) {
+
+	if _, _, err := splitSQLStatements(strings.NewReader("CREATE TABLE post (id int);\n"), true); err == nil {
+		t.Error("expected an error for a script with no Up/Down annotations")
+	}
+}
+
+func TestPreamble(t *testing.T) {
+
+	header := `-- Copyright 2016 Example, Inc.
+--
+-- Licensed under the Apache License, Version 2.0;
+-- you may not use this file except in compliance with the License.
+
+/*
+ * Tables for the blog; see docs/schema.md. DROP TABLE post;
+ */
+
+`
+	body := `-- +goose Up
+CREATE TABLE post (id int);
+
+-- +goose Down
+DROP TABLE post;
+`
+
+	for _, direction := range []bool{true, false} {
+		want, _, err := splitSQLStatements(strings.NewReader(body), direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := splitSQLStatements(strings.NewReader(header+body), direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("direction %v: got statements %q, want %q", direction, got, want)
+		}
+	}
+
+	// as is anything else before the first section
+	src := "-- header\nCREATE TABLE post (id int);\n" + body
+	got, _, err := splitSQLStatements(strings.NewReader(src), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-- +goose Up\nCREATE TABLE post (id int);\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got statements %q, want %q", got, want)
+	}
+}
+
+func TestPartlyAppliedError(t *testing.T) {
+
+	stmts, _, err := splitSQLStatements(strings.NewReader(commenttxt), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isDDL(stmts[0]) || isDDL(stmts[1]) {
+		t.Errorf("incorrect DDL detection for %q and %q", stmts[0], stmts[1])
+	}
+
+	cause := errors.New("Error 1062: Duplicate entry '2' for key 'PRIMARY'")
+
+	// the CREATE TABLE was committed before the last INSERT failed
+	err = partlyAppliedError(stmts[:2], stmts[2], cause)
+	if !errors.Is(err, cause) || !strings.Contains(err.Error(), "the 1 statement(s)") {
+		t.Errorf("expected the CREATE TABLE to be reported as committed, got %v", err)
+	}
+
+	exists := errors.New("Error 1050: Table 'post' already exists")
+	if err = partlyAppliedError(nil, stmts[0], exists); !strings.Contains(err.Error(), "earlier run") {
+		t.Errorf("expected a hint about an earlier partial run, got %v", err)
+	}
+
+	if err = partlyAppliedError(nil, stmts[1], cause); err != cause {
+		t.Errorf("expected the error unchanged, got %v", err)
+	}
+}
+
+func TestSplitCombinedMigrations(t *testing.T) {
+
+	bad := []string{
+		"",
+		"-- just a comment\n",
+		"SELECT 1;\n-- +goose Version: 1\n",
+		"-- +goose Version: one\n",
+		"-- +goose Version: 0\n",
+	}
+
+	for _, src := range bad {
+		if _, err := splitCombinedMigrations([]byte(src)); err == nil {
+			t.Errorf("expected an error for %q", src)
+		}
+	}
+}
+
+func TestSQLTemplate(t *testing.T) {
+
+	src := "-- +goose TEMPLATE\n-- +goose Up\n{{ range .Tenants }}CREATE TABLE {{ . }}_post (id int);\n{{ end }}"
+	conf := &DBConf{TemplateData: map[string]interface{}{"Tenants": []string{"acme", "globex"}}}
+
+	r, err := sqlSource(conf, []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts, _, err := splitSQLStatements(r, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 2 || !strings.Contains(stmts[0], "acme_post") || !strings.Contains(stmts[1], "globex_post") {
+		t.Errorf("incorrect templated statements: %q", stmts)
+	}
+
+	// missing data
+	if _, err = sqlSource(&DBConf{}, []byte(src)); err == nil {
+		t.Error("expected an error for missing template data")
+	}
+
+	// without the annotation, {{ is just SQL
+	plain := "-- +goose Up\nSELECT '{{ .Tenants }}';\n"
+	if r, err = sqlSource(conf, []byte(plain)); err != nil {
+		t.Fatal(err)
+	}
+	if stmts, _, _ = splitSQLStatements(r, true); len(stmts) != 1 || !strings.Contains(stmts[0], "{{ .Tenants }}") {
+		t.Errorf("unannotated script was templated: %q", stmts)
+	}
+}
+
+func TestStatementError(t *testing.T) {
+
+	stmts, _, err := splitSQLStatements(strings.NewReader(commenttxt), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cause := errors.New("syntax error")
+	err = statementError(20130106093224, 0, stmts[0], cause)
+	if !errors.Is(err, cause) {
+		t.Errorf("expected the driver's error to be wrapped, got %v", err)
+	}
+	want := "migration 20130106093224 statement #1 failed: CREATE TABLE post ( id int NOT NULL, -- the id; not null title text /* the title...: syntax error"
+	if err.Error() != want {
+		t.Errorf("incorrect error.\ngot  %s\nwant %s", err, want)
+	}
+
+	if got := statementPrefix("SELECT 1;\n", 80); got != "SELECT 1;" {
+		t.Errorf("incorrect short statement prefix. got %q", got)
+	}
+}
+
+func TestWindowsLineEndings(t *testing.T) {
+
+	want, _, err := splitSQLStatements(strings.NewReader(multitxt), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crlf := strings.ReplaceAll(multitxt, "\n", "\r\n")
+	scripts := map[string]string{
+		"crlf":     crlf,
+		"bom":      "\xef\xbb\xbf" + multitxt,
+		"bom+crlf": "\xef\xbb\xbf" + crlf,
+	}
+
+	for name, script := range scripts {
+		r, err := sqlSource(&DBConf{}, []byte(script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts, _, err := splitSQLStatements(r, true)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if strings.Join(stmts, "") != strings.Join(want, "") {
+			t.Errorf("%s: incorrect stmts. got %q, want %q", name, stmts, want)
+		}
+
+		if ok, err := sqlHasAnnotation([]byte(script), "Up"); err != nil || !ok {
+			t.Errorf("%s: Up annotation not found", name)
+		}
+	}
+
+	sections, err := splitCombinedMigrations([]byte("\xef\xbb\xbf-- +goose Version: 1\r\n" + crlf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 1 || bytes.Contains(sections[0].src, []byte("\r")) {
+		t.Errorf("incorrect sections. got %+v", sections)
+	}
+}
+
+func TestSQLTimeout(t *testing.T) {
+
+	tests := []struct {
+		sql     string
+		timeout time.Duration
+		err     bool
+	}{
+		{sql: functxt, timeout: 0},
+		{sql: "-- +goose TIMEOUT 30s\n" + functxt, timeout: 30 * time.Second},
+		{sql: "-- +goose Up\r\n-- +goose TIMEOUT 1m30s\r\nSELECT 1;\r\n", timeout: 90 * time.Second},
+		{sql: "-- +goose TIMEOUT\n" + functxt, err: true},
+		{sql: "-- +goose TIMEOUT soon\n" + functxt, err: true},
+		{sql: "-- +goose TIMEOUT -5s\n" + functxt, err: true},
+	}
+
+	for _, test := range tests {
+		timeout, err := sqlTimeout([]byte(test.sql))
+		if (err != nil) != test.err {
+			t.Errorf("unexpected error %v for %q", err, test.sql[:30])
+		}
+		if timeout != test.timeout {
+			t.Errorf("incorrect timeout. got %v, want %v", timeout, test.timeout)
+		}
+	}
+}
+
+func TestSQLCondition(t *testing.T) {
+
+	conf := &DBConf{EnvVars: map[string]string{"TIER": "enterprise", "REGION": "us east"}}
+
+	tests := []struct {
+		sql   string
+		holds bool
+		err   bool
+	}{
+		{sql: functxt, holds: true},
+		{sql: "-- +goose ONLY IF TIER = enterprise\n" + functxt, holds: true},
+		{sql: "-- +goose ONLY IF TIER == free\n" + functxt, holds: false},
+		{sql: "-- +goose ONLY IF TIER != free\r\n" + functxt, holds: true},
+		{sql: "-- +goose ONLY IF TIER=enterprise AND REGION = 'us east'\n" + functxt, holds: true},
+		{sql: "-- +goose ONLY IF TIER = enterprise AND REGION != \"us east\"\n" + functxt, holds: false},
+		{sql: "-- +goose ONLY IF PLAN = \"\"\n" + functxt, holds: true},
+		{sql: "-- +goose ONLY IF\n" + functxt, err: true},
+		{sql: "-- +goose ONLY IF TIER\n" + functxt, err: true},
+		{sql: "-- +goose ONLY IF TIER > 2\n" + functxt, err: true},
+	}
+
+	for _, test := range tests {
+		holds, _, err := sqlCondition(conf, []byte(test.sql))
+		if (err != nil) != test.err {
+			t.Errorf("unexpected error %v for %q", err, test.sql[:30])
+		}
+		if err == nil && holds != test.holds {
+			t.Errorf("incorrect condition for %q. got %v, want %v", test.sql[:30], holds, test.holds)
+		}
+	}
+
+	// unset variables are only an error with StrictEnv
+	conf.StrictEnv = true
+	if _, _, err := sqlCondition(conf, []byte("-- +goose ONLY IF PLAN = free\n")); err == nil {
+		t.Error("expected an error for an unset variable")
+	}
+}
+
+// an error reporting its SQLSTATE, as lib/pq's and pgx's do
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sqlstate " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestRetryDelay(t *testing.T) {
+
+	conf := &DBConf{Driver: DBDriver{Dialect: &PostgresDialect{}}, Retries: 2}
+	deadlock := fmt.Errorf("migration 1 statement #1 failed: %w", sqlStateError("40P01"))
+
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if delay, retry := retryDelay(conf, attempt, deadlock); !retry || delay != want {
+			t.Errorf("attempt %d: got %v, %v, want %v, true", attempt, delay, retry, want)
+		}
+	}
+	if _, retry := retryDelay(conf, 2, deadlock); retry {
+		t.Error("expected no more retries once they've run out")
+	}
+	if _, retry := retryDelay(conf, 0, sqlStateError("42P01")); retry {
+		t.Error("expected no retry for an undefined table")
+	}
+	if _, retry := retryDelay(conf, 0, nil); retry {
+		t.Error("expected no retry without an error")
+	}
+
+	conf.Driver.Dialect = &MySqlDialect{}
+	if _, retry := retryDelay(conf, 0, errors.New("Error 1213 (40001): Deadlock found when trying to get lock")); !retry {
+		t.Error("expected a mysql deadlock to be retried")
+	}
+
+	// dialects that don't say what's retryable never retry
+	conf.Driver.Dialect = &Sqlite3Dialect{}
+	if _, retry := retryDelay(conf, 0, deadlock); retry {
+		t.Error("expected no retry under sqlite3")
+	}
+
+	if anyDDL([]string{"UPDATE post SET title = '';\n"}) || !anyDDL([]string{"INSERT INTO post VALUES (1);\n", "ALTER TABLE post ADD COLUMN x int;\n"}) {
+		t.Error("incorrect anyDDL")
+	}
+}
+
+func TestVerifySection(t *testing.T) {
+
+	tests := []struct {
+		section string
+		count   int
+	}{
+		{section: "Up", count: 2},
+		{section: "Verify", count: 1},
+		{section: "Down", count: 1},
+	}
+
+	for _, test := range tests {
+		stmts, _, err := splitSQLSection(strings.NewReader(verifytxt), test.section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stmts) != test.count {
+			t.Errorf("%s: incorrect number of stmts. got %v, want %v", test.section, len(stmts), test.count)
+		}
+	}
+
+	values := []struct {
+		val  interface{}
+		want bool
+	}{
+		{val: true, want: true},
+		{val: false, want: false},
+		{val: int64(0), want: true},
+		{val: int64(3), want: false},
+		{val: float64(0), want: true},
+		{val: "0", want: true},
+		{val: "12", want: false},
+		{val: "t", want: true},
+		{val: "f", want: false},
+		{val: nil, want: false},
+	}
+
+	for _, v := range values {
+		if got := verifiedValue(v.val); got != v.want {
+			t.Errorf("verifiedValue(%#v). got %v, want %v", v.val, got, v.want)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+
+	conf := &DBConf{EnvVars: map[string]string{"SCHEMA": "app", "ROLE": "reader"}}
+
+	tests := []struct {
+		sql      string
+		expanded string
+	}{
+		{sql: "GRANT SELECT ON ${SCHEMA}.post TO $ROLE;", expanded: "GRANT SELECT ON app.post TO reader;"},
+		{sql: "SELECT '$UNSET';", expanded: "SELECT '';"},
+		{sql: "AS $$ SELECT $1 $$", expanded: "AS $$ SELECT $1 $$"},
+		{sql: "AS $body$ SELECT 1 $body$", expanded: "AS $body$ SELECT 1 $body$"},
+		{sql: "SELECT a$ROLE, ${SCHEMA", expanded: "SELECT a$ROLE, ${SCHEMA"},
+	}
+
+	for _, test := range tests {
+		expanded, err := expandSQLEnv(conf, test.sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expanded != test.expanded {
+			t.Errorf("incorrect expansion of %q. got %q, want %q", test.sql, expanded, test.expanded)
+		}
+	}
+
+	conf.StrictEnv = true
+	if _, err := expandSQLEnv(conf, "SELECT '$UNSET';"); err == nil {
+		t.Error("expected an error for an unset variable in strict mode")
+	}
+}
+
 var functxt = `-- +goose Up
 CREATE TABLE IF NOT EXISTS histories (
   id                BIGSERIAL  PRIMARY KEY,
@@ -145,3 +629,77 @@ CREATE TABLE fancier_post (
 -- +goose Down
 DROP TABLE fancier_post;
 `
+
+// statements that postgres refuses to run inside a transaction
+var notxtxt = `-- +goose NO TRANSACTION
+-- +goose Up
+CREATE INDEX CONCURRENTLY post_title_idx ON post (title);
+
+-- +goose Down
+DROP INDEX CONCURRENTLY post_title_idx;
+`
+
+// dollar-quoted function bodies, without StatementBegin/StatementEnd
+var dollartxt = `-- +goose Up
+CREATE FUNCTION add_one(integer) RETURNS integer AS $$
+BEGIN
+  RETURN $1 + 1;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION notify_post() RETURNS trigger AS $func$
+BEGIN
+  PERFORM pg_notify('post', $body$a; b$body$);
+  RETURN NEW;
+END;
+$func$ LANGUAGE plpgsql;
+
+SELECT add_one($1);
+
+-- +goose Down
+DROP FUNCTION notify_post();
+DROP FUNCTION add_one(integer);
+`
+
+// semicolons and comment markers within string literals and quoted identifiers
+var quotetxt = `-- +goose Up
+CREATE TABLE "weird;name" ("id""; x" int, body text);
+INSERT INTO "weird;name" VALUES (1, 'first; value');
+INSERT INTO "weird;name" VALUES (2, 'it''s; escaped');
+INSERT INTO "weird;name" VALUES (3, 'spans -- not a comment;
+multiple; lines');
+
+-- +goose Down
+DROP TABLE "weird;name";
+`
+
+// semicolons within comments, both inside and between statements
+var commenttxt = `-- +goose Up
+-- create the table; then fill it
+CREATE TABLE post (
+    id int NOT NULL, -- the id; not null
+    title text /* the title; maybe */
+);
+
+/* seed data;
+   /* nested; */
+   still a comment; */
+INSERT INTO post VALUES (1, 'hello');
+INSERT INTO post /* ; */ VALUES (2, 'world'); -- done;
+
+-- +goose Down
+/* -- +goose is only an annotation at the start of a line; */
+DROP TABLE post;
+`
+
+// a backfill, checked by a Verify section
+var verifytxt = `-- +goose Up
+ALTER TABLE users ADD COLUMN tenant_id int;
+UPDATE users SET tenant_id = 1;
+
+-- +goose Verify
+SELECT count(*) FROM users WHERE tenant_id IS NULL;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN tenant_id;
+`
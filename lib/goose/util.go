@@ -2,6 +2,7 @@ package goose
 
 import (
 	"io"
+	"io/fs"
 	"os"
 	"text/template"
 )
@@ -23,6 +24,20 @@ func writeTemplateToFile(path string, t *template.Template, data interface{}) (s
 	return f.Name(), nil
 }
 
+// osFS is an fs.FS over the local filesystem that, unlike os.DirFS,
+// accepts the relative and absolute paths that os.Open does.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) { return os.Open(name) }
+
+// the filesystem that conf's migrations are read from
+func migrationsFS(conf *DBConf) fs.FS {
+	if conf.FS != nil {
+		return conf.FS
+	}
+	return osFS{}
+}
+
 func copyFile(dst, src string) (int64, error) {
 	sf, err := os.Open(src)
 	if err != nil {
@@ -0,0 +1,42 @@
+package goose
+
+import (
+	"reflect"
+	"runtime/debug"
+	"strings"
+)
+
+// the version reported when the build doesn't record which
+// version of goose it was built with, e.g. a build of a local
+// checkout, as the go command reports its own
+const develVersion = "(devel)"
+
+// Version returns the version of goose that's running, e.g. v1.2.0,
+// as recorded by the go command for the module goose was built from,
+// or "(devel)" if it doesn't know, e.g. for a local checkout.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return develVersion
+	}
+	return moduleVersion(info, reflect.TypeOf(DBConf{}).PkgPath())
+}
+
+// the version of the module, of those in info, that provides pkg
+func moduleVersion(info *debug.BuildInfo, pkg string) string {
+
+	modules := append([]*debug.Module{&info.Main}, info.Deps...)
+	for _, m := range modules {
+		if m.Path == "" || (pkg != m.Path && !strings.HasPrefix(pkg, m.Path+"/")) {
+			continue
+		}
+		if m.Replace != nil {
+			m = m.Replace
+		}
+		if m.Version != "" {
+			return m.Version
+		}
+	}
+
+	return develVersion
+}